@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dbsystel/grafana-config-controller/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// return an informer on the configmaps of all namespaces feeding the controller, like the configmap controller of
+// the common package, whose informer is not accessible to wait until it has synced
+func newConfigMapInformer(k8sClient *kubernetes.Clientset, c *controller.Controller) cache.SharedIndexInformer {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return k8sClient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return k8sClient.CoreV1().ConfigMaps(metav1.NamespaceAll).Watch(options)
+			},
+		},
+		&v1.ConfigMap{},
+		3*time.Minute,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.Create,
+		UpdateFunc: c.Update,
+		DeleteFunc: c.Delete,
+	})
+	return informer
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElectionConfig is the lease replicas of the controller compete for
+type leaderElectionConfig struct {
+	Namespace     string
+	Name          string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// run fn with a context which is cancelled when this replica loses the lease,
+// return when ctx is done or the lease is lost and fn returned
+func runLeaderElection(ctx context.Context, k8sClient *kubernetes.Clientset, config leaderElectionConfig, fn func(ctx context.Context), logger log.Logger) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, config.Namespace, config.Name, k8sClient.CoreV1(), k8sClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return err
+	}
+
+	// fn is started in its own goroutine by the elector, it must not start anymore once the election returned
+	var mtx sync.Mutex
+	started, finished := false, false
+	stopped := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		Name:          config.Name,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		// give up the lease on shutdown, so another replica takes over without waiting for it to expire
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				mtx.Lock()
+				if finished {
+					mtx.Unlock()
+					return
+				}
+				started = true
+				mtx.Unlock()
+				level.Info(logger).Log("msg", "Started leading", "identity", identity)
+				fn(ctx)
+				close(stopped)
+			},
+			OnStoppedLeading: func() {
+				level.Info(logger).Log("msg", "Stopped leading", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					level.Info(logger).Log("msg", "New leader elected: "+leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Waiting for leadership", "lease", config.Namespace+"/"+config.Name, "identity", identity)
+	elector.Run(ctx)
+
+	mtx.Lock()
+	finished = true
+	wait := started
+	mtx.Unlock()
+	if wait {
+		<-stopped
+	}
+	return nil
+}
@@ -1,19 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/dbsystel/grafana-config-controller/controller"
 	"github.com/dbsystel/grafana-config-controller/grafana"
-	"github.com/dbsystel/kube-controller-dbsystel-go-common/controller/configmap"
 	"github.com/dbsystel/kube-controller-dbsystel-go-common/kubernetes"
 	k8sflag "github.com/dbsystel/kube-controller-dbsystel-go-common/kubernetes/flag"
 	opslog "github.com/dbsystel/kube-controller-dbsystel-go-common/log"
@@ -26,8 +24,36 @@ import (
 var (
 	app = kingpin.New(filepath.Base(os.Args[0]), "Grafana Controller")
 	//Here you can define more flags for your application
-	grafanaUrl = app.Flag("grafana-url", "The url to issue requests to update dashboards to.").Required().String()
-	id         = app.Flag("id", "The grafana id to issue requests to update dashboards to.").Default("0").Int()
+	grafanaUrl                  = app.Flag("grafana-url", "The url to issue requests to update dashboards to.").Required().String()
+	id                          = app.Flag("id", "The grafana id to issue requests to update dashboards to.").Default("0").Int()
+	grafanaTimeout              = app.Flag("grafana-timeout", "The overall timeout of a Grafana API call including retries, 0 disables it.").Default("5m").Duration()
+	grafanaRequestTimeout       = app.Flag("grafana-request-timeout", "The timeout of a single HTTP request to the Grafana API, 0 disables it.").Default("30s").Duration()
+	retryMaxAttempts            = app.Flag("grafana-retry-max-attempts", "The maximum number of attempts of a failed Grafana API request, 0 retries until --grafana-timeout.").Default("10").Int()
+	retryInitialBackoff         = app.Flag("grafana-retry-initial-backoff", "The wait time after the first failed Grafana API request, doubled after every further attempt.").Default("500ms").Duration()
+	retryMaxBackoff             = app.Flag("grafana-retry-max-backoff", "The maximum wait time between two attempts of a Grafana API request.").Default("30s").Duration()
+	caFile                      = app.Flag("grafana-ca-file", "The CA bundle to verify the certificate of Grafana, the system CAs are used if empty.").String()
+	certFile                    = app.Flag("grafana-cert-file", "The client certificate presented to Grafana.").String()
+	keyFile                     = app.Flag("grafana-key-file", "The key of the client certificate presented to Grafana.").String()
+	serverName                  = app.Flag("grafana-server-name", "Overrides the server name used to verify the certificate of Grafana.").String()
+	insecureSkipVerify          = app.Flag("grafana-insecure-skip-verify", "Disables the verification of the certificate of Grafana.").Default("false").Bool()
+	user                        = app.Flag("grafana-user", "The user for basic auth against Grafana.").Envar("GRAFANA_USER").String()
+	password                    = app.Flag("grafana-password", "The password for basic auth against Grafana.").Envar("GRAFANA_PASSWORD").String()
+	token                       = app.Flag("grafana-token", "The service account token or API key to authenticate against Grafana.").Envar("GRAFANA_BEARER_TOKEN").String()
+	tokenFile                   = app.Flag("grafana-token-file", "The file containing the service account token or API key, it is read again when it changes.").String()
+	createOrgs                  = app.Flag("create-orgs", "Create the organization named in the grafana.net/org annotation if it does not exist.").Default("false").Bool()
+	workers                     = app.Flag("workers", "The number of ConfigMaps synced to Grafana in parallel.").Default("1").Int()
+	maxRequeues                 = app.Flag("max-requeues", "The number of retries with exponential backoff of a ConfigMap which failed to sync, 0 retries forever.").Default("15").Int()
+	resyncInterval              = app.Flag("resync-interval", "The interval of checking Grafana for dashboards, datasources and notification channels which were deleted or changed outside of their ConfigMaps, 0 disables it.").Default("5m").Duration()
+	adoptUnowned                = app.Flag("adopt-unowned", "Update and delete Grafana objects which carry no owner marker, e.g. created by an earlier version of the controller.").Default("false").Bool()
+	garbageCollection           = app.Flag("garbage-collection", "Delete or only report Grafana objects owned by the controller whose ConfigMap does not exist anymore, checked on start and every --resync-interval.").Default(controller.GarbageCollectionDelete).Enum(controller.GarbageCollectionDelete, controller.GarbageCollectionReport, controller.GarbageCollectionOff)
+	namespaceLabel              = app.Flag("notification-policy-namespace-label", "The alert label matched against the namespace of the ConfigMap of a notification policy subtree.").Default("namespace").String()
+	leaderElect                 = app.Flag("leader-elect", "Elect a leader with a Lease, so only one of several replicas syncs the ConfigMaps to Grafana.").Default("false").Bool()
+	leaderElectionNamespace     = app.Flag("leader-election-namespace", "The namespace of the Lease used for the leader election.").Envar("POD_NAMESPACE").Default("default").String()
+	leaderElectionName          = app.Flag("leader-election-name", "The name of the Lease used for the leader election.").Default("grafana-config-controller").String()
+	leaderElectionLeaseDuration = app.Flag("leader-election-lease-duration", "The time replicas wait before taking over the Lease of a leader which stopped renewing it.").Default("15s").Duration()
+	leaderElectionRenewDeadline = app.Flag("leader-election-renew-deadline", "The time the leader retries renewing its Lease before it gives up leadership.").Default("10s").Duration()
+	leaderElectionRetryPeriod   = app.Flag("leader-election-retry-period", "The interval of trying to acquire or renew the Lease.").Default("2s").Duration()
+	dryRun                      = app.Flag("dry-run", "Only log the requests which would change Grafana, with the diff of their payload against the current state.").Default("false").Bool()
 )
 
 func main() {
@@ -69,57 +95,121 @@ func main() {
 		os.Exit(2)
 	}
 
-	if os.Getenv("GRAFANA_USER") != "" && os.Getenv("GRAFANA_PASSWORD") == "" {
-		gUrl.User = url.User(os.Getenv("GRAFANA_USER"))
+	//Credentials in the url are used as basic auth if nothing else is configured
+	urlUser := gUrl.User
+	gUrl.User = nil
+
+	g := grafana.New(gUrl, *id, logger)
+	switch {
+	case *tokenFile != "":
+		g.Auth, err = grafana.NewTokenFileAuth(*tokenFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Grafana token file could not be read: "+*tokenFile, "err", err.Error())
+			os.Exit(2)
+		}
+	case *token != "":
+		g.Auth = &grafana.TokenAuth{Token: *token}
+	case *user != "":
+		g.Auth = &grafana.BasicAuth{User: *user, Password: *password}
+	case urlUser != nil:
+		urlPassword, _ := urlUser.Password()
+		g.Auth = &grafana.BasicAuth{User: urlUser.Username(), Password: urlPassword}
 	}
+	g.Timeout = *grafanaTimeout
+	g.RequestTimeout = *grafanaRequestTimeout
+	retryPolicy := grafana.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = *retryMaxAttempts
+	retryPolicy.InitialBackoff = *retryInitialBackoff
+	retryPolicy.MaxBackoff = *retryMaxBackoff
+	g.RetryPolicy = retryPolicy
+	err = g.ConfigureTLS(grafana.TLSConfig{
+		CAFile:             *caFile,
+		CertFile:           *certFile,
+		KeyFile:            *keyFile,
+		ServerName:         *serverName,
+		InsecureSkipVerify: *insecureSkipVerify,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "TLS configuration for Grafana could not be loaded", "err", err.Error())
+		os.Exit(2)
+	}
+
+	sigs := make(chan os.Signal, 1) // Create channel to receive OS signals
+
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGINT) // Register the sigs channel to receieve SIGTERM
+
+	ctx, cancel := context.WithCancel(context.Background()) // Create context which aborts in-flight Grafana calls on shutdown
+	go func() {
+		<-sigs // Wait for signals (this hangs until a signal arrives)
+		cancel()
+	}()
 
-	if os.Getenv("GRAFANA_USER") != "" && os.Getenv("GRAFANA_PASSWORD") != "" {
-		gUrl.User = url.UserPassword(os.Getenv("GRAFANA_USER"), os.Getenv("GRAFANA_PASSWORD"))
+	caps, err := g.DetectCapabilitiesContext(ctx)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Grafana version could not be detected, assuming Grafana 5/6 API until it is detected on a resync", "err", err.Error())
+	} else {
+		level.Info(logger).Log("msg", "Detected Grafana "+caps.Version, "legacyAlerting", caps.LegacyAlerting, "unifiedAlerting", caps.UnifiedAlerting, "provisioningAPI", caps.ProvisioningAPI, "nestedFolders", caps.NestedFolders, "libraryPanels", caps.LibraryPanels)
 	}
 
-	g := grafana.New(gUrl, *id, logger)
+	var client grafana.Client = g
+	if *dryRun {
+		level.Info(logger).Log("msg", "Dry run: Grafana is not changed")
+		client = grafana.NewDryRunClient(g, logger)
+	}
 
 	if os.Getenv("MONITORING_PASSWORD") != "" {
-		createMonitoringUser(g, logger)
+		createMonitoringUser(ctx, client, logger)
 	}
 
-	sigs := make(chan os.Signal, 1) // Create channel to receive OS signals
-	stop := make(chan struct{})     // Create channel to receive stop signal
-
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGINT) // Register the sigs channel to receieve SIGTERM
+	//Sync the configmaps to grafana until ctx is done
+	run := func(ctx context.Context) {
+		stop := make(chan struct{}) // Create channel to receive stop signal
+		wg := &sync.WaitGroup{}     // Goroutines can add themselves to this to be waited on so that they finish
 
-	wg := &sync.WaitGroup{} // Goroutines can add themselves to this to be waited on so that they finish
+		//Initialize new k8s configmap-controller from common k8s package
+		c := controller.New(ctx, client, k8sClient, controller.Config{Id: *id, CreateOrgs: *createOrgs, Workers: *workers, MaxRequeues: *maxRequeues, ResyncInterval: *resyncInterval, AdoptUnowned: *adoptUnowned, GarbageCollection: *garbageCollection, NamespaceLabel: *namespaceLabel, DryRun: *dryRun}, logger)
+		informer := newConfigMapInformer(k8sClient, c)
+		//Run the workers syncing the queued configmaps to grafana, garbage is collected once the informer has synced
+		wg.Add(1)
+		go c.Run(stop, wg, informer.HasSynced)
+		//Run the informer queueing the configmaps
+		go informer.Run(stop)
 
-	//Initialize new k8s configmap-controller from common k8s package
-	configMapController := &configmap.ConfigMapController{}
-	configMapController.Controller = controller.New(*g, logger)
-	configMapController.Initialize(k8sClient)
-	//Run initiated configmap-controller as go routine
-	go configMapController.Run(stop, wg)
+		<-ctx.Done() // Wait for shutdown or lost leadership
 
-	<-sigs // Wait for signals (this hangs until a signal arrives)
+		level.Info(logger).Log("msg", "Shutting down...")
 
-	level.Info(logger).Log("msg", "Shutting down...")
+		close(stop) // Tell goroutines to stop themselves
+		wg.Wait()   // Wait for all to be stopped
+	}
 
-	close(stop) // Tell goroutines to stop themselves
-	wg.Wait()   // Wait for all to be stopped
+	if !*leaderElect {
+		run(ctx)
+		return
+	}
+	//Only the replica holding the lease syncs, the grafana calls of a replica losing it are cancelled
+	err = runLeaderElection(ctx, k8sClient, leaderElectionConfig{
+		Namespace:     *leaderElectionNamespace,
+		Name:          *leaderElectionName,
+		LeaseDuration: *leaderElectionLeaseDuration,
+		RenewDeadline: *leaderElectionRenewDeadline,
+		RetryPeriod:   *leaderElectionRetryPeriod,
+	}, run, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Leader election could not be started", "err", err.Error())
+		os.Exit(2)
+	}
+	if ctx.Err() == nil {
+		//The lease was lost, restart to compete for it again with a fresh state
+		level.Error(logger).Log("msg", "Lost leadership")
+		os.Exit(1)
+	}
 }
 
-func createMonitoringUser(g *grafana.APIClient, logger log.Logger) {
+func createMonitoringUser(ctx context.Context, g grafana.Client, logger log.Logger) {
 	level.Info(logger).Log("msg", "Creating monitoring user...")
-	user := "{\"name\": \"Monitoring\", \"login\":\"monitoring\", \"password\": \"" + os.Getenv("MONITORING_PASSWORD") + "\", \"role\": \"Viewer\"}"
-	err := g.CreateUser(strings.NewReader(user))
-	if err != nil {
-		for strings.Contains(err.Error(), "timeout") {
-			level.Error(logger).Log("err", err.Error())
-			level.Info(logger).Log("msg", "Perhaps Grafana is not ready. Waiting for 8 seconds and retry again...")
-			time.Sleep(8 * time.Second)
-			err = g.CreateUser(strings.NewReader(user))
-			if err == nil {
-				break
-			}
-		}
-	}
+	user := grafana.User{Name: "Monitoring", Login: "monitoring", Password: os.Getenv("MONITORING_PASSWORD"), Role: "Viewer"}
+	err := g.CreateUserContext(ctx, user)
 	if err != nil {
 		level.Info(logger).Log("msg", "Failed to create monitoring user")
 		level.Error(logger).Log("err", err.Error())
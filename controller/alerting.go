@@ -0,0 +1,309 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// fields of alert rules which are set by grafana
+var ignoredAlertRuleFields = []string{"id", "orgID", "updated", "provenance"}
+
+// alertRuleFile is a grafana alerting provisioning file, a configmap entry holds one file or a single group
+type alertRuleFile struct {
+	Groups []alertRuleGroup `json:"groups"`
+}
+
+// alertRuleGroup is a rule group in the provisioning format, its folder is given by title
+type alertRuleGroup struct {
+	Name   string `json:"name"`
+	Folder string `json:"folder"`
+	// Interval is a duration like 1m or a number of seconds
+	Interval interface{}         `json:"interval"`
+	Rules    []grafana.AlertRule `json:"rules"`
+}
+
+// parse the alert rule groups of a configmap entry in json or yaml
+func parseAlertRuleGroups(v string) ([]alertRuleGroup, error) {
+	data, err := yaml.YAMLToJSON([]byte(v))
+	if err != nil {
+		return nil, err
+	}
+	var file alertRuleFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Groups) == 0 {
+		var group alertRuleGroup
+		if err = json.Unmarshal(data, &group); err != nil {
+			return nil, err
+		}
+		file.Groups = []alertRuleGroup{group}
+	}
+	for _, group := range file.Groups {
+		if group.Name == "" {
+			return nil, errors.New("alert rule group without name")
+		}
+	}
+	return file.Groups, nil
+}
+
+// return the evaluation interval of a group in seconds, grafana evaluates every minute by default
+func (group alertRuleGroup) interval() (int64, error) {
+	switch interval := group.Interval.(type) {
+	case nil:
+		return 60, nil
+	case float64:
+		return int64(interval), nil
+	case string:
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return 0, errors.New("invalid interval of alert rule group " + group.Name + ": " + err.Error())
+		}
+		return int64(d / time.Second), nil
+	}
+	return 0, errors.New("invalid interval of alert rule group " + group.Name)
+}
+
+// return the folder of an alert rule group, given in the group or by grafana.net/folder,
+// it is created if it does not exist and create is set, nil is returned if it does not exist
+func (c *Controller) alertRuleFolder(ctx context.Context, configmapObj *v1.ConfigMap, group alertRuleGroup, create bool) (*grafana.Folder, error) {
+	title := group.Folder
+	if title == "" {
+		fd, _ := configmapObj.Annotations["grafana.net/folder"]
+		title = folderTitle(fd, configmapObj)
+	}
+	if title == "" {
+		return nil, errors.New("alert rule group " + group.Name + " has no folder, set folder in the group or the grafana.net/folder annotation")
+	}
+	if create {
+		return c.searchFolder(ctx, title)
+	}
+	return getFolder(ctx, c, title)
+}
+
+// return the alert rule group to save for a group of the entry of owner o, the rules are stamped with their owner
+// and get a uid derived from the owner, group and title if they have none
+func buildAlertRuleGroup(o owner, group alertRuleGroup, folderUid string) (grafana.AlertRuleGroup, error) {
+	interval, err := group.interval()
+	if err != nil {
+		return grafana.AlertRuleGroup{}, err
+	}
+	result := grafana.AlertRuleGroup{Title: group.Name, FolderUid: folderUid, Interval: interval, Rules: []grafana.AlertRule{}}
+	for _, rule := range group.Rules {
+		rule.Id = 0
+		rule.OrgId = 0
+		rule.FolderUid = folderUid
+		rule.RuleGroup = group.Name
+		rule.For = formatDuration(rule.For)
+		if rule.Uid == "" {
+			rule.Uid = o.alertRuleUid(group.Name, rule.Title)
+		}
+		o.stampAlertRule(&rule)
+		result.Rules = append(result.Rules, rule)
+	}
+	return result, nil
+}
+
+// save the alert rule groups of a configmap entry, groups which were removed from the entry are deleted
+func (c *Controller) saveAlertRules(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	groups, err := parseAlertRuleGroups(v)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchAlertRulesContext(ctx)
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	saved := make(map[string]bool)
+	for _, group := range groups {
+		folder, err := c.alertRuleFolder(ctx, configmapObj, group, true)
+		if err != nil {
+			return err
+		}
+		ruleGroup, err := buildAlertRuleGroup(o, group, folder.Uid)
+		if err != nil {
+			return err
+		}
+		if err = c.checkAlertRuleOwner(live, ruleGroup, configmapObj); err != nil {
+			return err
+		}
+		if _, err = c.g.UpdateAlertRuleGroupContext(ctx, ruleGroup); err != nil {
+			return err
+		}
+		saved[ruleGroup.FolderUid+"/"+ruleGroup.Title] = true
+	}
+	for _, rule := range live {
+		if ro, stamped := parseOwner(rule.Annotations[ownerAnnotation]); stamped && ro == o && !saved[rule.FolderUid+"/"+rule.RuleGroup] {
+			level.Info(c.logger).Log("msg", "Deleting alert rule of removed group: "+rule.Title, "group", rule.RuleGroup, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.DeleteAlertRuleContext(ctx, rule.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete the alert rules created from a configmap entry
+func (c *Controller) deleteAlertRules(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	live, err := c.g.SearchAlertRulesContext(ctx)
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	deleted := false
+	for _, rule := range live {
+		if ro, stamped := parseOwner(rule.Annotations[ownerAnnotation]); stamped && ro == o {
+			if err = c.g.DeleteAlertRuleContext(ctx, rule.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "alert rules not found"}
+	}
+	return nil
+}
+
+// update alert rules per key: save added and changed keys and delete the rules of removed keys
+func (c *Controller) updateAlertRules(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	return c.updateEntries(oldConfigmapObj, configmapObj, c.saveAlertRules, c.deleteAlertRules)
+}
+
+// re-apply the alert rules of entries whose groups are missing or changed
+func (c *Controller) repairAlertRules(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		groups, err := parseAlertRuleGroups(v)
+		if err != nil {
+			continue
+		}
+		changed, err := c.alertRulesDrifted(ctx, configmapObj, k, groups)
+		if err != nil {
+			failed = c.logRepair(err, k, configmapObj, failed)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Drift detected, alert rule group is missing or was changed, updating alert rules: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		err = c.saveAlertRules(ctx, configmapObj, k, v)
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// does a group of a configmap entry differ from the live group in grafana, only the fields given in the entry are compared
+func (c *Controller) alertRulesDrifted(ctx context.Context, configmapObj *v1.ConfigMap, k string, groups []alertRuleGroup) (bool, error) {
+	for _, group := range groups {
+		folder, err := c.alertRuleFolder(ctx, configmapObj, group, false)
+		if err != nil || folder == nil {
+			return folder == nil, err
+		}
+		desired, err := buildAlertRuleGroup(c.owner(configmapObj, k), group, folder.Uid)
+		if err != nil {
+			return false, err
+		}
+		live, err := c.g.GetAlertRuleGroupContext(ctx, folder.Uid, group.Name)
+		if grafana.IsNotFound(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if live.Interval != desired.Interval || len(live.Rules) != len(desired.Rules) {
+			return true, nil
+		}
+		for _, rule := range desired.Rules {
+			liveRule := findAlertRule(live.Rules, rule.Uid)
+			data, _ := json.Marshal(rule)
+			if liveRule == nil || drifted(entryFields(string(data)), liveRule, ignoredAlertRuleFields) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// return an error if the group or one of its rules exists in grafana with rules not owned by the configmap,
+// saving the group would replace them, rules without owner with the uid and title of a rule of the group are taken over
+func (c *Controller) checkAlertRuleOwner(live []grafana.AlertRule, group grafana.AlertRuleGroup, configmapObj *v1.ConfigMap) error {
+	titles := make(map[string]string)
+	for _, rule := range group.Rules {
+		titles[rule.Uid] = rule.Title
+	}
+	for _, rule := range live {
+		title, declared := titles[rule.Uid]
+		sameGroup := rule.FolderUid == group.FolderUid && rule.RuleGroup == group.Title
+		if !sameGroup && !declared {
+			continue
+		}
+		exact := sameGroup && declared && rule.Title == title
+		if o, stamped := parseOwner(rule.Annotations[ownerAnnotation]); !c.mayAdopt(o, stamped, exact, configmapObj) {
+			return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "alert rule " + rule.Title + " in group " + rule.RuleGroup + " exists which is not owned by the configmap"}
+		}
+	}
+	return nil
+}
+
+// search alert rule by uid
+func findAlertRule(rules []grafana.AlertRule, uid string) *grafana.AlertRule {
+	for _, rule := range rules {
+		if rule.Uid == uid {
+			return &rule
+		}
+	}
+	return nil
+}
+
+// return the uid of an alert rule without uid, derived from its owner, group and title
+func (o owner) alertRuleUid(group string, title string) string {
+	sum := sha1.Sum([]byte(o.Namespace + "/" + o.ConfigMap + "/" + o.Key + "/" + group + "/" + title))
+	return hex.EncodeToString(sum[:])
+}
+
+// format a duration like grafana does, e.g. 1m30s, so unchanged rules show no drift, invalid durations are kept
+func formatDuration(s string) string {
+	d, err := time.ParseDuration(s)
+	if s == "" || err != nil || d < 0 {
+		return s
+	}
+	if d == 0 {
+		return "0s"
+	}
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+	result := ""
+	for _, unit := range units {
+		if n := d / unit.duration; n > 0 {
+			result += strconv.FormatInt(int64(n), 10) + unit.name
+			d -= n * unit.duration
+		}
+	}
+	return result
+}
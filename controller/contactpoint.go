@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// fields of contact points which are set by grafana
+var ignoredContactPointFields = []string{"provenance"}
+
+// redactedSetting is the value grafana returns for the secure settings of a contact point
+const redactedSetting = "[REDACTED]"
+
+// return the contact point of the entry k of a configmap in json or yaml, stamped with its owner,
+// it gets a uid derived from namespace, configmap and key if it has none
+func (c *Controller) buildContactPoint(configmapObj *v1.ConfigMap, k string, v string) (grafana.ContactPoint, error) {
+	var contactPoint grafana.ContactPoint
+	data, err := yaml.YAMLToJSON([]byte(v))
+	if err != nil {
+		return contactPoint, err
+	}
+	if err = json.Unmarshal(data, &contactPoint); err != nil {
+		return contactPoint, err
+	}
+	o := c.owner(configmapObj, k)
+	if contactPoint.Uid == "" {
+		contactPoint.Uid = o.uid()
+	}
+	contactPoint.Provenance = ""
+	o.stampContactPoint(&contactPoint)
+	return contactPoint, nil
+}
+
+// create or update the contact point of a configmap entry by its uid, a contact point created from the entry
+// before with another uid is deleted
+func (c *Controller) saveContactPoint(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	contactPoint, err := c.buildContactPoint(configmapObj, k, v)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchContactPointsContext(ctx)
+	if err != nil {
+		return err
+	}
+	if existing := findContactPoint(live, contactPoint.Uid); existing == nil {
+		err = c.g.CreateContactPointContext(ctx, contactPoint)
+	} else if o, stamped := parseOwner(existing.Settings[ownerField]); !c.mayAdopt(o, stamped, existing.Name == contactPoint.Name, configmapObj) {
+		return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a contact point with the same uid which is not owned by the configmap exists"}
+	} else {
+		err = c.g.UpdateContactPointContext(ctx, contactPoint)
+	}
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	for _, existing := range live {
+		if eo, stamped := parseOwner(existing.Settings[ownerField]); stamped && eo == o && existing.Uid != contactPoint.Uid {
+			level.Info(c.logger).Log("msg", "Deleting contact point with previous uid: "+existing.Name, "uid", existing.Uid, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.DeleteContactPointContext(ctx, existing.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete the contact point created from a configmap entry
+func (c *Controller) deleteContactPoint(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	contactPoint, err := c.buildContactPoint(configmapObj, k, configmapObj.Data[k])
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchContactPointsContext(ctx)
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	deleted := false
+	for _, existing := range live {
+		eo, stamped := parseOwner(existing.Settings[ownerField])
+		if (stamped && eo == o) || (existing.Uid == contactPoint.Uid && c.mayTouch(eo, stamped, configmapObj)) {
+			if err = c.g.DeleteContactPointContext(ctx, existing.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "contact point not found"}
+	}
+	return nil
+}
+
+// update contact points per key: save added and changed keys and delete the contact points of removed keys
+func (c *Controller) updateContactPoints(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	return c.updateEntries(oldConfigmapObj, configmapObj, c.saveContactPoint, c.deleteContactPoint)
+}
+
+// re-apply missing or changed contact points
+func (c *Controller) repairContactPoints(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchContactPointsContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		contactPoint, err := c.buildContactPoint(configmapObj, k, v)
+		if err != nil {
+			continue
+		}
+		existing := findContactPoint(live, contactPoint.Uid)
+		if existing == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, contact point is missing, creating contact point: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.CreateContactPointContext(ctx, contactPoint)
+		} else if contactPointDrifted(contactPoint, existing) {
+			if o, stamped := parseOwner(existing.Settings[ownerField]); !c.mayTouch(o, stamped, configmapObj) {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "Drift detected, contact point was changed, updating contact point: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.UpdateContactPointContext(ctx, contactPoint)
+		} else {
+			continue
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// does the live contact point differ from the desired one, secure settings redacted by grafana are not compared
+func contactPointDrifted(desired grafana.ContactPoint, live *grafana.ContactPoint) bool {
+	data, _ := json.Marshal(desired)
+	fields := entryFields(string(data))
+	if settings, ok := fields["settings"].(map[string]interface{}); ok {
+		for k := range settings {
+			if live.Settings[k] == redactedSetting {
+				delete(settings, k)
+			}
+		}
+	}
+	return drifted(fields, live, ignoredContactPointFields)
+}
+
+// search contact point by uid
+func findContactPoint(contactPoints []grafana.ContactPoint, uid string) *grafana.ContactPoint {
+	for _, contactPoint := range contactPoints {
+		if contactPoint.Uid == uid {
+			return &contactPoint
+		}
+	}
+	return nil
+}
@@ -1,212 +1,485 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
-	"regexp"
+	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dbsystel/grafana-config-controller/grafana"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 type Controller struct {
 	logger log.Logger
-	g      grafana.APIClient
+	g      grafana.Client
+	// kclient lists the configmaps for the garbage collection
+	kclient kubernetes.Interface
+	config  Config
+	// recorder records events on the configmaps, it is nil without kclient
+	recorder record.EventRecorder
+	// sink sends the recorded events to kubernetes until it is stopped
+	sink watch.Interface
+	// ctx is cancelled on shutdown and aborts all in-flight grafana calls
+	ctx context.Context
+	// queue holds the namespace/name keys of configmaps waiting to be synced to grafana
+	queue workqueue.RateLimitingInterface
+
+	mtx sync.Mutex
+	// desired is the latest version of every configmap handled by this controller
+	desired map[string]*v1.ConfigMap
+	// applied is the version of every configmap last synced to grafana successfully
+	applied map[string]*v1.ConfigMap
+	// repairs holds the configmaps to check for drift in grafana on their next sync
+	repairs map[string]bool
+	// muteTimings holds the names of the mute timings created from each configmap, loaded from its annotation
+	muteTimings map[string]map[string]bool
+	// statuses holds the sync status last written to each configmap, a configmap synced again with the same outcome is not patched
+	statuses map[string]string
+	// policyMtx serializes reading and writing the notification policy trees, which are shared by all configmaps
+	policyMtx sync.Mutex
+}
+
+// Config holds the options of the controller
+type Config struct {
+	// Id is the grafana.net/id of the configmaps handled by this controller
+	Id int
+	// CreateOrgs creates the organization named in grafana.net/org if it does not exist
+	CreateOrgs bool
+	// Workers is the number of configmaps synced in parallel
+	Workers int
+	// MaxRequeues is the number of retries of a failed configmap before it is dropped until its next change or resync, 0 retries forever
+	MaxRequeues int
+	// ResyncInterval is the interval of checking grafana for drift from the configmaps, 0 disables it
+	ResyncInterval time.Duration
+	// AdoptUnowned lets configmaps update and delete grafana objects without owner, e.g. created by an earlier version
+	AdoptUnowned bool
+	// GarbageCollection is one of GarbageCollectionDelete, GarbageCollectionReport or GarbageCollectionOff,
+	// orphaned grafana objects are collected on start and every ResyncInterval
+	GarbageCollection string
+	// NamespaceLabel is the alert label matched against the namespace of notification policy subtrees
+	NamespaceLabel string
+	// DryRun is set if the grafana client only logs the requests changing grafana, the configmaps get the status
+	// Planned and events with Planned reasons instead of being marked as synced
+	DryRun bool
 }
 
-// d something when a configmap created
+// enqueue a created configmap
 func (c *Controller) Create(obj interface{}) {
-	configmapObj := obj.(*v1.ConfigMap)
+	c.enqueue(obj)
+}
+
+// enqueue an updated configmap
+func (c *Controller) Update(oldobj interface{}, newobj interface{}) {
+	c.enqueue(newobj)
+}
+
+// enqueue a deleted configmap, its last synced version is deleted from grafana
+func (c *Controller) Delete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	configmapObj, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		level.Error(c.logger).Log("msg", "Skipping deleted object which is no configmap", "type", fmt.Sprintf("%T", obj))
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(configmapObj)
+	if err != nil {
+		level.Error(c.logger).Log("err", err.Error())
+		return
+	}
+	c.mtx.Lock()
+	delete(c.desired, key)
+	_, applied := c.applied[key]
+	c.mtx.Unlock()
+	if applied {
+		c.queue.Add(key)
+	}
+}
+
+// create all grafana objects of a configmap
+func (c *Controller) create(configmapObj *v1.ConfigMap) error {
 	id, _ := configmapObj.Annotations["grafana.net/id"]
-	dh, _ := configmapObj.Annotations["grafana.net/dashboard"]
-	ds, _ := configmapObj.Annotations["grafana.net/datasource"]
-	nc, _ := configmapObj.Annotations["grafana.net/notification-channel"]
-	isGrafanaDashboards, _ := strconv.ParseBool(dh)
-	isGrafanaDatasource, _ := strconv.ParseBool(ds)
-	isGrafanaNotificationChannel, _ := strconv.ParseBool(nc)
 	grafanaId, _ := strconv.Atoi(id)
-	if grafanaId == c.g.Id && (isGrafanaDashboards || isGrafanaDatasource || isGrafanaNotificationChannel) {
-		var err error
+	kind := kindOf(configmapObj)
+	if grafanaId == c.config.Id && kind != kindNone {
+		if err := c.checkCapabilities(configmapObj); err != nil {
+			level.Error(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace, "err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonUnsupported, err.Error())
+			return unsupported(err)
+		}
+		ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+		if err != nil {
+			level.Info(c.logger).Log("msg", "Failed to resolve organization of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+			level.Error(c.logger).Log("err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonOrganizationFailed, "Failed to resolve organization "+configmapObj.Annotations["grafana.net/org"]+": "+err.Error())
+			return err
+		}
+		var failed error
+		var hits []grafana.SearchHit
 		for k, v := range configmapObj.Data {
-			if isGrafanaDatasource {
+			switch kind {
+			case kindDatasource:
 				level.Info(c.logger).Log("msg", "Creating datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				err = c.g.CreateDatasource(strings.NewReader(v))
-			} else if isGrafanaDashboards {
-				if !regexp.MustCompile("^{\\s*\"dashboard\":(\\s*.*)*").MatchString(v) {
-					v = "{\n  \"dashboard\":\n    " + strings.TrimSpace(v) + ",\n  \"overwrite\": true\n}"
+				err = c.saveDatasource(ctx, configmapObj, k, v)
+			case kindLibraryPanel:
+				level.Info(c.logger).Log("msg", "Creating library panel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.saveLibraryPanel(ctx, configmapObj, k, v)
+			case kindDashboard:
+				if hits == nil {
+					hits, err = c.g.SearchDashboardContext(ctx)
 				}
-				fd, _ := configmapObj.Annotations["grafana.net/folder"]
-				v, _ = c.checkFolderId(fd, configmapObj, v)
-				level.Info(c.logger).Log("msg", "Creating dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				err = c.g.CreateDashboard(strings.NewReader(v))
-			} else {
+				if err == nil {
+					level.Info(c.logger).Log("msg", "Creating dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+					err = c.saveDashboard(ctx, hits, configmapObj, k, v)
+				}
+			case kindAlertRule:
+				level.Info(c.logger).Log("msg", "Creating alert rules: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.saveAlertRules(ctx, configmapObj, k, v)
+			case kindContactPoint:
+				level.Info(c.logger).Log("msg", "Creating contact point: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.saveContactPoint(ctx, configmapObj, k, v)
+			case kindNotificationPolicy:
+				level.Info(c.logger).Log("msg", "Creating notification policy: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.savePolicy(ctx, configmapObj, k, v)
+			case kindMuteTiming:
+				level.Info(c.logger).Log("msg", "Creating mute timing: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.saveMuteTiming(ctx, configmapObj, k, v)
+			case kindNotificationTemplate:
+				level.Info(c.logger).Log("msg", "Creating notification template: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.saveTemplate(ctx, configmapObj, k, v)
+			default:
 				level.Info(c.logger).Log("msg", "Creating notification-channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				err = c.g.CreateNotificationChannel(strings.NewReader(v))
+				err = c.saveNotificationChannel(ctx, configmapObj, k, v)
 			}
 
-			if err != nil {
+			if grafana.IsPreconditionFailed(err) || grafana.IsConflict(err) {
+				level.Info(c.logger).Log("msg", "Failed to create: "+k+", it was changed in between or another object with the same name exists which is not owned by the configmap", "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				level.Error(c.logger).Log("err", err.Error())
+				c.event(configmapObj, v1.EventTypeWarning, reasonCreateFailed, "Failed to create "+kind.String()+" "+k+": "+err.Error())
+				failed = worse(failed, permanent(err))
+			} else if err != nil {
 				level.Info(c.logger).Log("msg", "Failed to create: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
 				level.Error(c.logger).Log("err", err.Error())
+				c.event(configmapObj, v1.EventTypeWarning, reasonCreateFailed, "Failed to create "+kind.String()+" "+k+": "+err.Error())
+				failed = worse(failed, err)
 			} else {
 				level.Info(c.logger).Log("msg", "Succeeded: Created: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				c.event(configmapObj, v1.EventTypeNormal, reasonCreated, "Created "+kind.String()+" "+k)
 			}
 		}
-	} else {
-		level.Debug(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name)
+		return failed
 	}
+	level.Debug(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name)
+	return nil
 }
 
-// do something when a configmap updated
-func (c *Controller) Update(oldobj interface{}, newobj interface{}) {
-	configmapObj := newobj.(*v1.ConfigMap)
+// sync the changes between two versions of a configmap to grafana
+func (c *Controller) update(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
 	id, _ := configmapObj.Annotations["grafana.net/id"]
-	ds, _ := configmapObj.Annotations["grafana.net/datasource"]
-	nc, _ := configmapObj.Annotations["grafana.net/notification-channel"]
 	grafanaId, _ := strconv.Atoi(id)
-	isGrafanaDatasource, _ := strconv.ParseBool(ds)
-	isGrafanaNotificationChannel, _ := strconv.ParseBool(nc)
-	if noDifference(oldobj.(*v1.ConfigMap), configmapObj) {
+	kind := kindOf(configmapObj)
+	if noDifference(oldConfigmapObj, configmapObj) {
 		level.Debug(c.logger).Log("msg", "Skipping automatically updated configmap:"+configmapObj.Name)
-		return
+		return nil
 	}
-	if grafanaId != c.g.Id {
+	if grafanaId != c.config.Id {
 		level.Debug(c.logger).Log("msg", "Skipping configmap:"+configmapObj.Name)
-		return
+		return nil
 	}
-	if isGrafanaNotificationChannel {
-		c.updateNotificationChannels(configmapObj)
-	} else if isGrafanaDatasource {
-		c.updateDatasource(configmapObj)
-	} else {
-		c.Delete(oldobj)
-		c.Create(newobj)
+	if err := c.checkCapabilities(configmapObj); err != nil {
+		level.Error(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace, "err", err.Error())
+		c.event(configmapObj, v1.EventTypeWarning, reasonUnsupported, err.Error())
+		return unsupported(err)
+	}
+	if oldConfigmapObj.Annotations["grafana.net/org"] == configmapObj.Annotations["grafana.net/org"] && kindOf(oldConfigmapObj) == kind {
+		switch kind {
+		case kindDatasource:
+			return c.updateEntries(oldConfigmapObj, configmapObj, c.saveDatasource, c.deleteDatasource)
+		case kindNotificationChannel:
+			return c.updateEntries(oldConfigmapObj, configmapObj, c.saveNotificationChannel, c.deleteNotificationChannel)
+		case kindAlertRule:
+			return c.updateAlertRules(oldConfigmapObj, configmapObj)
+		case kindContactPoint:
+			return c.updateContactPoints(oldConfigmapObj, configmapObj)
+		case kindNotificationPolicy:
+			if isPolicyRoot(oldConfigmapObj) == isPolicyRoot(configmapObj) {
+				return c.updatePolicies(oldConfigmapObj, configmapObj)
+			}
+		case kindMuteTiming:
+			return c.updateMuteTimings(oldConfigmapObj, configmapObj)
+		case kindNotificationTemplate:
+			return c.updateTemplates(oldConfigmapObj, configmapObj)
+		case kindLibraryPanel:
+			return c.updateLibraryPanels(oldConfigmapObj, configmapObj)
+		case kindDashboard:
+			return c.updateDashboards(oldConfigmapObj, configmapObj)
+		}
+	}
+	// the objects move to another organization, or the configmap switched between kinds of objects
+	if err := c.delete(oldConfigmapObj); err != nil {
+		return err
 	}
+	return c.create(configmapObj)
 }
 
-// do something when a configmap deleted
-func (c *Controller) Delete(obj interface{}) {
-	configmapObj := obj.(*v1.ConfigMap)
+// delete all grafana objects of a configmap
+func (c *Controller) delete(configmapObj *v1.ConfigMap) error {
 	id, _ := configmapObj.Annotations["grafana.net/id"]
-	dh, _ := configmapObj.Annotations["grafana.net/dashboard"]
-	ds, _ := configmapObj.Annotations["grafana.net/datasource"]
-	nc, _ := configmapObj.Annotations["grafana.net/notification-channel"]
-	isGrafanaDashboards, _ := strconv.ParseBool(dh)
-	isGrafanaDatasource, _ := strconv.ParseBool(ds)
-	isGrafanaNotificationChannel, _ := strconv.ParseBool(nc)
 	grafanaId, _ := strconv.Atoi(id)
+	kind := kindOf(configmapObj)
 
-	if grafanaId == c.g.Id && (isGrafanaDashboards || isGrafanaDatasource || isGrafanaNotificationChannel) {
-		var err error
-		for k, v := range configmapObj.Data {
-			if isGrafanaDatasource {
+	if grafanaId == c.config.Id && kind != kindNone {
+		if err := c.checkCapabilities(configmapObj); err != nil {
+			level.Error(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace, "err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonUnsupported, err.Error())
+			return unsupported(err)
+		}
+		ctx, err := c.orgContext(configmapObj, false)
+		if grafana.IsNotFound(err) {
+			level.Info(c.logger).Log("msg", "Organization already deleted of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+			return nil
+		} else if err != nil {
+			level.Info(c.logger).Log("msg", "Failed to resolve organization of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+			level.Error(c.logger).Log("err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonOrganizationFailed, "Failed to resolve organization "+configmapObj.Annotations["grafana.net/org"]+": "+err.Error())
+			return err
+		}
+		var failed error
+		var hits []grafana.SearchHit
+		for k := range configmapObj.Data {
+			switch kind {
+			case kindDatasource:
 				level.Info(c.logger).Log("msg", "Deleting datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				err = c.g.DeleteDatasource(strings.NewReader(v))
-			} else if isGrafanaDashboards {
-				if !regexp.MustCompile("\\{\\s*\"dashboard\":").MatchString(v) {
-					v = "{\n  \"dashboard\":\n    " + strings.TrimSpace(v) + ",\n  \"overwrite\": true\n}"
+				err = c.deleteDatasource(ctx, configmapObj, k)
+			case kindLibraryPanel:
+				level.Info(c.logger).Log("msg", "Deleting library panel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteLibraryPanel(ctx, configmapObj, k)
+			case kindDashboard:
+				if hits == nil {
+					hits, err = c.g.SearchDashboardContext(ctx)
 				}
-				level.Info(c.logger).Log("msg", "Deleting dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				gd, _ := c.g.SearchDashboard()
-				fd, _ := configmapObj.Annotations["grafana.net/folder"]
-				v, _ := c.checkFolderId(fd, configmapObj, v)
-				uid := c.lookUpUid(gd, strings.NewReader(v))
-				level.Debug(c.logger).Log("uid", uid)
-				err = c.g.DeleteDashboard(uid)
-			} else {
-				level.Info(c.logger).Log("msg", "Deleting notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-				ans, _ := c.g.SearchNotificationChannel()
-				an := c.lookUpId(ans, strings.NewReader(v))
-				if int(an["id"].(float64)) != -1 {
-					err = c.g.DeleteNotificationChannel(int(an["id"].(float64)))
-				} else {
-					err = errors.New("notification channel not found")
+				if err == nil {
+					level.Info(c.logger).Log("msg", "Deleting dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+					err = c.deleteDashboard(ctx, hits, configmapObj, k)
 				}
+			case kindAlertRule:
+				level.Info(c.logger).Log("msg", "Deleting alert rules: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteAlertRules(ctx, configmapObj, k)
+			case kindContactPoint:
+				level.Info(c.logger).Log("msg", "Deleting contact point: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteContactPoint(ctx, configmapObj, k)
+			case kindNotificationPolicy:
+				level.Info(c.logger).Log("msg", "Deleting notification policy: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deletePolicy(ctx, configmapObj, k)
+			case kindMuteTiming:
+				level.Info(c.logger).Log("msg", "Deleting mute timing: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteMuteTiming(ctx, configmapObj, k)
+			case kindNotificationTemplate:
+				level.Info(c.logger).Log("msg", "Deleting notification template: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteTemplate(ctx, configmapObj, k)
+			default:
+				level.Info(c.logger).Log("msg", "Deleting notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				err = c.deleteNotificationChannel(ctx, configmapObj, k)
 			}
-			if err != nil {
+			if grafana.IsNotFound(err) {
+				level.Info(c.logger).Log("msg", "Already deleted: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			} else if err != nil {
 				level.Info(c.logger).Log("msg", "Failed to delete: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
 				level.Error(c.logger).Log("err", err.Error())
+				c.event(configmapObj, v1.EventTypeWarning, reasonDeleteFailed, "Failed to delete "+kind.String()+" "+k+": "+err.Error())
+				failed = err
 			} else {
 				level.Info(c.logger).Log("msg", "Succeeded: Deleted: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+				c.event(configmapObj, v1.EventTypeNormal, reasonDeleted, "Deleted "+kind.String()+" "+k)
 			}
 		}
-	} else {
-		level.Debug(c.logger).Log("msg", "Skipping configmap:"+configmapObj.Name)
+		return failed
 	}
+	level.Debug(c.logger).Log("msg", "Skipping configmap:"+configmapObj.Name)
+	return nil
 }
 
-// create new Controller instance
-func New(g grafana.APIClient, logger log.Logger) *Controller {
+// create new Controller instance, grafana calls are cancelled when ctx is done
+func New(ctx context.Context, g grafana.Client, kclient kubernetes.Interface, config Config, logger log.Logger) *Controller {
 	controller := &Controller{}
 	controller.logger = logger
 	controller.g = g
+	controller.kclient = kclient
+	if kclient != nil {
+		broadcaster := record.NewBroadcaster()
+		controller.sink = broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kclient.CoreV1().Events(metav1.NamespaceAll)})
+		controller.recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "grafana-config-controller"})
+	}
+	controller.config = config
+	controller.ctx = ctx
+	controller.queue = workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Second, 5*time.Minute), "configmaps")
+	controller.desired = make(map[string]*v1.ConfigMap)
+	controller.applied = make(map[string]*v1.ConfigMap)
+	controller.repairs = make(map[string]bool)
+	controller.muteTimings = make(map[string]map[string]bool)
+	controller.statuses = make(map[string]string)
 	return controller
 }
 
-// if a dashboard has folder, search the folder in grafana and return the folder id or create a new folder and return the folder id
-func (c *Controller) checkFolderId(fd string, configmapObj *v1.ConfigMap, v string) (string, int) {
-	fid := 0
-	if fd == "" {
-		return v, fid
+// is a configmap annotated for the grafana of this controller
+func (c *Controller) handles(configmapObj *v1.ConfigMap) bool {
+	id, _ := configmapObj.Annotations["grafana.net/id"]
+	grafanaId, _ := strconv.Atoi(id)
+	return grafanaId == c.config.Id && kindOf(configmapObj) != kindNone
+}
+
+// undetectedCapabilities are assumed as long as the grafana version could not be detected, only the API of Grafana 5 and 6
+// without library panels and unified alerting
+var undetectedCapabilities = grafana.NewCapabilities("of unknown version")
+
+// return the detected capabilities of grafana or undetectedCapabilities if its version is not known yet
+func (c *Controller) capabilities() *grafana.Capabilities {
+	if caps := c.g.Capabilities(); caps != nil {
+		return caps
 	}
-	hasFolder, isString := strconv.ParseBool(fd)
-	if (hasFolder && isString == nil) || (!hasFolder && isString != nil) {
-		if hasFolder {
-			fid = c.searchFolder(configmapObj.Namespace)
-		} else {
-			fid = c.searchFolder(fd)
-		}
+	return undetectedCapabilities
+}
 
-		m := make(map[string]interface{})
+// detect the grafana version again if it could not be detected before, configmaps refused meanwhile are synced on the next resync
+func (c *Controller) detectCapabilities() {
+	if c.g.Capabilities() != nil {
+		return
+	}
+	caps, err := c.g.DetectCapabilitiesContext(c.ctx)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Grafana version could not be detected, assuming Grafana 5/6 API", "err", err.Error())
+		return
+	}
+	level.Info(c.logger).Log("msg", "Detected Grafana "+caps.Version, "legacyAlerting", caps.LegacyAlerting, "unifiedAlerting", caps.UnifiedAlerting, "provisioningAPI", caps.ProvisioningAPI, "nestedFolders", caps.NestedFolders, "libraryPanels", caps.LibraryPanels)
+}
 
-		err := json.Unmarshal([]byte(v), &m)
-		if err != nil {
-			level.Error(c.logger).Log("msg", "Format error in dashboard: "+v, "err", err.Error())
+// return an error if the detected grafana version cannot honor the annotations of a configmap
+func (c *Controller) checkCapabilities(configmapObj *v1.ConfigMap) error {
+	caps := c.capabilities()
+	switch kind := kindOf(configmapObj); kind {
+	case kindNotificationChannel:
+		if !caps.LegacyAlerting {
+			return errors.New(kind.annotation() + " needs legacy alerting, which is not available in Grafana " + caps.Version)
 		}
+	case kindAlertRule, kindContactPoint, kindNotificationPolicy, kindMuteTiming, kindNotificationTemplate:
+		if !caps.UnifiedAlerting {
+			return errors.New(kind.annotation() + " needs unified alerting, which is not enabled in Grafana " + caps.Version)
+		}
+		if !caps.ProvisioningAPI {
+			return errors.New(kind.annotation() + " needs the alerting provisioning API of Grafana 9.0 or later, which is not available in Grafana " + caps.Version)
+		}
+	case kindLibraryPanel:
+		if !caps.LibraryPanels {
+			return errors.New(kind.annotation() + " needs library panels, which are not available in Grafana " + caps.Version)
+		}
+	}
+	return nil
+}
 
-		m["folderID"] = fid
-
-		byte_v, err := json.Marshal(m)
+// return a context scoping all grafana calls to the organization given by grafana.net/org as id or name,
+// an organization given by name is created if it does not exist and createOrg is set
+func (c *Controller) orgContext(configmapObj *v1.ConfigMap, createOrg bool) (context.Context, error) {
+	org, _ := configmapObj.Annotations["grafana.net/org"]
+	if org == "" {
+		return c.ctx, nil
+	}
+	if orgId, err := strconv.Atoi(org); err == nil {
+		return grafana.WithOrgId(c.ctx, orgId), nil
+	}
+	o, err := c.g.GetOrgByNameContext(c.ctx, org)
+	if grafana.IsNotFound(err) && createOrg {
+		level.Info(c.logger).Log("msg", "Creating organization: "+org)
+		o, err = c.g.CreateOrgContext(c.ctx, grafana.Org{Name: org})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return grafana.WithOrgId(c.ctx, o.Id), nil
+}
 
-		if err != nil {
-			level.Error(c.logger).Log("msg", "Format error in dashboard: "+v, "err", err.Error())
-		}
+// if a dashboard has folder, search the folder in grafana or create a new folder and set it on the dashboard
+func (c *Controller) checkFolderId(ctx context.Context, fd string, configmapObj *v1.ConfigMap, dh *grafana.Dashboard) error {
+	title := folderTitle(fd, configmapObj)
+	if title == "" {
+		return nil
+	}
+	folder, err := c.searchFolder(ctx, title)
+	if err != nil {
+		return err
+	}
+	dh.FolderId = folder.Id
+	if c.capabilities().FolderUids {
+		dh.FolderUid = folder.Uid
+	}
+	return nil
+}
 
-		v = string(byte_v)
+// return the title of the folder given by grafana.net/folder or "" if the dashboards have no folder
+func folderTitle(fd string, configmapObj *v1.ConfigMap) string {
+	hasFolder, isString := strconv.ParseBool(fd)
+	if fd == "" || (!hasFolder && isString == nil) {
+		return ""
+	}
+	if hasFolder {
+		return configmapObj.Namespace
 	}
-	return v, fid
+	return fd
 }
 
-// search folder id with title, return folder id
-func (c *Controller) searchFolder(title string) int {
-	fdJson := "{\"title\":\"" + title + "\"}"
-	fid := getFolderId(c, fdJson)
-	if fid == -1 {
-		level.Info(c.logger).Log("msg", "Creating folder: "+title)
-		err := c.g.CreateFolder(strings.NewReader(fdJson))
-		if err != nil {
-			level.Info(c.logger).Log("msg", "Failed to create folder: "+title)
-			level.Error(c.logger).Log("err", err.Error())
-		} else {
-			level.Info(c.logger).Log("msg", "Created folder: "+title)
+// search folder with title, create it if it does not exist
+func (c *Controller) searchFolder(ctx context.Context, title string) (*grafana.Folder, error) {
+	fd, err := getFolder(ctx, c, title)
+	if err != nil || fd != nil {
+		return fd, err
+	}
+	level.Info(c.logger).Log("msg", "Creating folder: "+title)
+	fd, err = c.g.CreateFolderContext(ctx, grafana.Folder{Title: title})
+	if grafana.IsConflict(err) {
+		level.Info(c.logger).Log("msg", "Folder was created in between: "+title)
+		fd, err = getFolder(ctx, c, title)
+		if err == nil && fd == nil {
+			err = errors.New("folder not found: " + title)
 		}
-		fid = getFolderId(c, fdJson)
+	} else if err != nil {
+		level.Info(c.logger).Log("msg", "Failed to create folder: "+title)
+	} else {
+		level.Info(c.logger).Log("msg", "Created folder: "+title)
 	}
-	return fid
+	return fd, err
 }
 
-// search folder id from a folder json
-func getFolderId(c *Controller, fdJson string) int {
-	fds, _ := c.g.SearchFolder()
-	fd := c.lookUpId(fds, strings.NewReader(fdJson))
-	return int(fd["id"].(float64))
+// search folder by title, return nil if not found
+func getFolder(ctx context.Context, c *Controller, title string) (*grafana.Folder, error) {
+	fds, err := c.g.SearchFolderContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		if strings.ToUpper(fd.Title) == strings.ToUpper(title) {
+			return &fd, nil
+		}
+	}
+	return nil, nil
 }
 
-// are two configmaps same
+// are two configmaps same, the status annotations written by the controller are ignored
 func noDifference(newConfigMap *v1.ConfigMap, oldConfigMap *v1.ConfigMap) bool {
 	if len(newConfigMap.Data) != len(oldConfigMap.Data) {
 		return false
@@ -216,112 +489,321 @@ func noDifference(newConfigMap *v1.ConfigMap, oldConfigMap *v1.ConfigMap) bool {
 			return false
 		}
 	}
-	if len(newConfigMap.Annotations) != len(oldConfigMap.Annotations) {
-		return false
-	}
-	for k, v := range newConfigMap.Annotations {
-		if v != oldConfigMap.Annotations[k] {
-			return false
+	for _, annotations := range [][2]map[string]string{{newConfigMap.Annotations, oldConfigMap.Annotations}, {oldConfigMap.Annotations, newConfigMap.Annotations}} {
+		for k, v := range annotations[0] {
+			if other, ok := annotations[1][k]; !isStatusAnnotation(k) && (!ok || v != other) {
+				return false
+			}
 		}
 	}
 	return true
 }
 
-// update notification channels
-func (c *Controller) updateNotificationChannels(configmapObj *v1.ConfigMap) {
-	var err error
+// update the grafana objects of a configmap per key: save added and changed keys with save and delete the objects
+// of removed keys with remove, which gets the old configmap
+func (c *Controller) updateEntries(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap,
+	save func(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error,
+	remove func(ctx context.Context, configmapObj *v1.ConfigMap, k string) error) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		level.Info(c.logger).Log("msg", "Failed to resolve organization of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Error(c.logger).Log("err", err.Error())
+		c.event(configmapObj, v1.EventTypeWarning, reasonOrganizationFailed, "Failed to resolve organization "+configmapObj.Annotations["grafana.net/org"]+": "+err.Error())
+		return err
+	}
+	oldFd, _ := oldConfigmapObj.Annotations["grafana.net/folder"]
+	fd, _ := configmapObj.Annotations["grafana.net/folder"]
+	kind := kindOf(configmapObj)
+
+	var failed error
 	for k, v := range configmapObj.Data {
-		level.Info(c.logger).Log("msg", "Updating notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-		an, _ := c.g.SearchNotificationChannel()
-		newNC := c.lookUpId(an, strings.NewReader(v))
-		if int(newNC["id"].(float64)) != -1 {
-			nc, _ := json.Marshal(newNC)
-			err = c.g.UpdateNotificationChannel(int(newNC["id"].(float64)), strings.NewReader(string(nc)))
-		} else {
-			err = errors.New("notification channel not found")
+		if oldV, existed := oldConfigmapObj.Data[k]; existed && oldV == v && oldFd == fd {
+			continue
 		}
-		if err != nil {
-			level.Info(c.logger).Log("msg", "Failed to update notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Info(c.logger).Log("msg", "Updating "+kind.String()+": "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		err = save(ctx, configmapObj, k, v)
+		if grafana.IsPreconditionFailed(err) || grafana.IsConflict(err) {
+			level.Info(c.logger).Log("msg", "Failed to update: "+k+", another object exists which is not owned by the configmap", "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			level.Error(c.logger).Log("err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonUpdateFailed, "Failed to update "+kind.String()+" "+k+": "+err.Error())
+			failed = worse(failed, permanent(err))
+		} else if err != nil {
+			level.Info(c.logger).Log("msg", "Failed to update: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
 			level.Error(c.logger).Log("err", err.Error())
-			level.Debug(c.logger).Log("msg", "Trying to create notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-			c.Create(configmapObj)
+			c.event(configmapObj, v1.EventTypeWarning, reasonUpdateFailed, "Failed to update "+kind.String()+" "+k+": "+err.Error())
+			failed = worse(failed, err)
 		} else {
 			level.Info(c.logger).Log("msg", "Succeeded: Updated: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			c.event(configmapObj, v1.EventTypeNormal, reasonUpdated, "Updated "+kind.String()+" "+k)
 		}
 	}
-}
 
-// update datesource
-func (c *Controller) updateDatasource(configmapObj *v1.ConfigMap) {
-	var err error
-	for k, v := range configmapObj.Data {
-		level.Info(c.logger).Log("msg", "Updating datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-		dss, _ := c.g.SearchDatasource()
-		newDS := c.lookUpId(dss, strings.NewReader(v))
-		if int(newDS["id"].(float64)) != -1 {
-			ds, _ := json.Marshal(newDS)
-			err = c.g.UpdateDatasource(int(newDS["id"].(float64)), strings.NewReader(string(ds)))
-		} else {
-			err = errors.New("datasource not found")
+	for k := range oldConfigmapObj.Data {
+		if _, ok := configmapObj.Data[k]; ok {
+			continue
 		}
-		if err != nil {
-			level.Info(c.logger).Log("msg", "Failed to update datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Info(c.logger).Log("msg", "Deleting "+kind.String()+": "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		err = remove(ctx, oldConfigmapObj, k)
+		if grafana.IsNotFound(err) {
+			level.Info(c.logger).Log("msg", "Already deleted: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		} else if err != nil {
+			level.Info(c.logger).Log("msg", "Failed to delete: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
 			level.Error(c.logger).Log("err", err.Error())
-			level.Debug(c.logger).Log("msg", "Trying to create datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
-			c.Create(configmapObj)
+			c.event(configmapObj, v1.EventTypeWarning, reasonDeleteFailed, "Failed to delete "+kind.String()+" "+k+": "+err.Error())
+			failed = err
 		} else {
-			level.Info(c.logger).Log("msg", "Succeeded: Updated: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			level.Info(c.logger).Log("msg", "Succeeded: Deleted: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			c.event(configmapObj, v1.EventTypeNormal, reasonDeleted, "Deleted "+kind.String()+" "+k)
 		}
 	}
+	return failed
 }
 
-// search uid of a given dashboard from a list of dashboards
-func (c *Controller) lookUpUid(dashboards []grafana.GrafanaDashboard, dashboardJSON io.Reader) string {
-	var newDashboard grafana.GrafanaDashboardConfigmap
-	err := json.NewDecoder(dashboardJSON).Decode(&newDashboard)
+// create or update the datasource of a configmap entry, a datasource created from the entry before with another name or type is deleted
+func (c *Controller) saveDatasource(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	var ds grafana.Datasource
+	if err := json.Unmarshal([]byte(v), &ds); err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	o.stampDatasource(&ds)
+	dss, err := c.g.SearchDatasourceContext(ctx)
 	if err != nil {
-		level.Error(c.logger).Log("err", err.Error())
+		return err
 	}
-	level.Debug(c.logger).Log("msg", "New dashboard name: "+newDashboard.Dashboard.Title)
-	for _, dh := range dashboards {
-		if dh.Type == "dash-db" && dh.Title == newDashboard.Dashboard.Title && newDashboard.FolderId == dh.FolderId {
-			return dh.Uid
+	ds.Id = lookUpDatasourceId(c.ownedDatasources(dss, configmapObj), ds)
+	if ds.Id == -1 {
+		ds.Id = adoptableDatasourceId(dss, ds)
+	}
+	for _, existing := range dss {
+		if eo, stamped := parseOwner(existing.JsonData[ownerField]); stamped && eo == o && existing.Id != ds.Id {
+			level.Info(c.logger).Log("msg", "Deleting datasource with previous name: "+existing.Name, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.DeleteDatasourceContext(ctx, existing.Name); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
 		}
 	}
-	return ""
+	if ds.Id != -1 {
+		err = c.g.UpdateDatasourceContext(ctx, ds)
+	}
+	if ds.Id == -1 || grafana.IsNotFound(err) {
+		ds.Id = 0
+		err = c.g.CreateDatasourceContext(ctx, ds)
+	}
+	return err
 }
 
-// search id of a given notification-channel or folder from a list of them and add the id into the json
-func (c *Controller) lookUpId(objs []map[string]interface{}, objJSON io.Reader) map[string]interface{} {
-	newObj := make(map[string]interface{})
-	err := json.NewDecoder(objJSON).Decode(&newObj)
+// delete the datasource created from a configmap entry
+func (c *Controller) deleteDatasource(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	var ds grafana.Datasource
+	if err := json.Unmarshal([]byte(configmapObj.Data[k]), &ds); err != nil {
+		return err
+	}
+	dss, err := c.g.SearchDatasourceContext(ctx)
 	if err != nil {
-		level.Error(c.logger).Log("err", err.Error())
+		return err
+	}
+	if id := lookUpDatasourceId(c.ownedDatasources(dss, configmapObj), ds); id == -1 {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "datasource not found"}
+	}
+	return c.g.DeleteDatasourceContext(ctx, ds.Name)
+}
+
+// create or update the notification channel of a configmap entry, a notification channel created from the entry before
+// with another name or type is deleted
+func (c *Controller) saveNotificationChannel(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	var nc grafana.NotificationChannel
+	if err := json.Unmarshal([]byte(v), &nc); err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	o.stampNotificationChannel(&nc)
+	ncs, err := c.g.SearchNotificationChannelContext(ctx)
+	if err != nil {
+		return err
 	}
-	if newObj["title"] != nil {
-		for _, obj := range objs {
-			if obj["title"] == nil {
-				continue
+	nc.Id = lookUpNotificationChannelId(c.ownedNotificationChannels(ncs, configmapObj), nc)
+	if nc.Id == -1 {
+		nc.Id = adoptableNotificationChannelId(ncs, nc)
+	}
+	for _, existing := range ncs {
+		if eo, stamped := parseOwner(existing.Settings[ownerField]); stamped && eo == o && existing.Id != nc.Id {
+			level.Info(c.logger).Log("msg", "Deleting notification channel with previous name: "+existing.Name, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.DeleteNotificationChannelContext(ctx, existing.Id); err != nil && !grafana.IsNotFound(err) {
+				return err
 			}
-			if strings.ToUpper(obj["title"].(string)) == strings.ToUpper(newObj["title"].(string)) {
-				newObj["id"] = obj["id"]
-				return newObj
+		}
+	}
+	if nc.Id != -1 {
+		err = c.g.UpdateNotificationChannelContext(ctx, nc)
+	}
+	if nc.Id == -1 || grafana.IsNotFound(err) {
+		nc.Id = 0
+		err = c.g.CreateNotificationChannelContext(ctx, nc)
+	}
+	return err
+}
+
+// delete the notification channel created from a configmap entry
+func (c *Controller) deleteNotificationChannel(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	var nc grafana.NotificationChannel
+	if err := json.Unmarshal([]byte(configmapObj.Data[k]), &nc); err != nil {
+		return err
+	}
+	ncs, err := c.g.SearchNotificationChannelContext(ctx)
+	if err != nil {
+		return err
+	}
+	id := lookUpNotificationChannelId(c.ownedNotificationChannels(ncs, configmapObj), nc)
+	if id == -1 {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "notification channel not found"}
+	}
+	return c.g.DeleteNotificationChannelContext(ctx, id)
+}
+
+// update dashboards per key: create added keys, delete removed keys and overwrite changed keys in place,
+// the dashboards are searched once for all keys
+func (c *Controller) updateDashboards(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	var hits []grafana.SearchHit
+	search := func(ctx context.Context) (err error) {
+		if hits == nil {
+			hits, err = c.g.SearchDashboardContext(ctx)
+		}
+		return err
+	}
+	return c.updateEntries(oldConfigmapObj, configmapObj,
+		func(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+			if err := search(ctx); err != nil {
+				return err
+			}
+			return c.saveDashboard(ctx, hits, configmapObj, k, v)
+		},
+		func(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+			if err := search(ctx); err != nil {
+				return err
 			}
+			return c.deleteDashboard(ctx, hits, configmapObj, k)
+		})
+}
+
+// save the dashboard of a configmap entry under its uid into its folder, so title changes and folder moves are updates in place,
+// a dashboard created from the entry with another uid is replaced, the dashboard of the entry is always overwritten
+func (c *Controller) saveDashboard(ctx context.Context, hits []grafana.SearchHit, configmapObj *v1.ConfigMap, k string, v string) error {
+	dh, err := parseDashboard(v)
+	if err != nil {
+		return err
+	}
+	if err = c.checkLibraryPanels(configmapObj, dh); err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	o.stampDashboard(&dh)
+	fd, _ := configmapObj.Annotations["grafana.net/folder"]
+	if err = c.checkFolderId(ctx, fd, configmapObj, &dh); err != nil {
+		return err
+	}
+	existing := lookUpUid(c.ownedDashboards(hits, configmapObj), dh, o)
+	if existing == "" {
+		existing = adoptableDashboardUid(hits, dh, o)
+	}
+	if dh.Uid() == "" {
+		if existing != "" {
+			dh.SetUid(existing)
+		} else {
+			dh.SetUid(o.uid())
 		}
-	} else {
-		if newObj["name"] != nil && newObj["type"] != nil {
-			for _, obj := range objs {
-				if obj["name"] == nil || obj["type"] == nil {
-					continue
-				}
-				if obj["name"].(string) == newObj["name"].(string) && obj["type"].(string) == newObj["type"].(string) {
-					newObj["id"] = obj["id"]
-					return newObj
-				}
+	}
+	if existing != "" && existing != dh.Uid() {
+		// the uid in the dashboard json was changed, grafana would save it over the existing dashboard with the same title
+		level.Info(c.logger).Log("msg", "Dashboard uid changed, replacing dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace, "uid", existing)
+		if err = c.g.DeleteDashboardContext(ctx, existing); err != nil && !grafana.IsNotFound(err) {
+			return err
+		}
+	}
+	if existing != "" {
+		dh.Overwrite = true
+	}
+	if dh.Overwrite {
+		if err = c.checkDashboardOwner(hits, dh, configmapObj); err != nil {
+			return err
+		}
+	}
+	_, err = c.g.CreateDashboardContext(ctx, dh)
+	return err
+}
+
+// delete the dashboard created from a configmap entry
+func (c *Controller) deleteDashboard(ctx context.Context, hits []grafana.SearchHit, configmapObj *v1.ConfigMap, k string) error {
+	dh, err := parseDashboard(configmapObj.Data[k])
+	if err != nil {
+		return err
+	}
+	uid := lookUpUid(c.ownedDashboards(hits, configmapObj), dh, c.owner(configmapObj, k))
+	if uid == "" {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "dashboard not found"}
+	}
+	return c.g.DeleteDashboardContext(ctx, uid)
+}
+
+// parse a dashboard from a configmap entry, which is either the raw dashboard model or the full envelope with "dashboard" key
+func parseDashboard(v string) (grafana.Dashboard, error) {
+	var dh grafana.Dashboard
+	m := make(map[string]interface{})
+	err := json.Unmarshal([]byte(v), &m)
+	if err != nil {
+		return dh, err
+	}
+	if _, ok := m["dashboard"]; ok {
+		err = json.Unmarshal([]byte(v), &dh)
+		return dh, err
+	}
+	dh.Model = m
+	dh.Overwrite = true
+	return dh, nil
+}
+
+// search the dashboard of a configmap entry by the uid in its json, or by the owner tag of the entry if the json has no uid
+// or the dashboard was created with another uid
+func lookUpDashboard(dashboards []grafana.SearchHit, newDashboard grafana.Dashboard, o owner) *grafana.SearchHit {
+	if uid := newDashboard.Uid(); uid != "" {
+		for _, dh := range dashboards {
+			if dh.Type == "dash-db" && dh.Uid == uid {
+				return &dh
 			}
 		}
 	}
+	for _, dh := range dashboards {
+		if dh.Type == "dash-db" && dashboardTag(dh.Tags) == o.tag() {
+			return &dh
+		}
+	}
+	return nil
+}
+
+// search uid of the dashboard of a configmap entry, return "" if not found
+func lookUpUid(dashboards []grafana.SearchHit, newDashboard grafana.Dashboard, o owner) string {
+	if dh := lookUpDashboard(dashboards, newDashboard, o); dh != nil {
+		return dh.Uid
+	}
+	return ""
+}
 
-	newObj["id"] = float64(-1)
-	return newObj
+// search id of a given datasource by name and type, return -1 if not found
+func lookUpDatasourceId(datasources []grafana.Datasource, newDatasource grafana.Datasource) int {
+	for _, ds := range datasources {
+		if ds.Name == newDatasource.Name && ds.Type == newDatasource.Type {
+			return ds.Id
+		}
+	}
+	return -1
+}
+
+// search id of a given notification channel by name and type, return -1 if not found
+func lookUpNotificationChannelId(notificationChannels []grafana.NotificationChannel, newNotificationChannel grafana.NotificationChannel) int {
+	for _, nc := range notificationChannels {
+		if nc.Name == newNotificationChannel.Name && nc.Type == newNotificationChannel.Type {
+			return nc.Id
+		}
+	}
+	return -1
 }
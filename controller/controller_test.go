@@ -0,0 +1,1354 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/dbsystel/grafana-config-controller/grafana/grafanatest"
+	"github.com/go-kit/kit/log"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// return a controller syncing to a MemoryClient, with a fake kubernetes holding objs if any are given
+func newTestController(t *testing.T, config Config, objs ...runtime.Object) (*Controller, *grafana.MemoryClient) {
+	g := grafana.NewMemoryClient()
+	var c *Controller
+	if objs != nil {
+		c = New(context.Background(), g, fake.NewSimpleClientset(objs...), config, log.NewNopLogger())
+	} else {
+		c = New(context.Background(), g, nil, config, log.NewNopLogger())
+	}
+	return c, g
+}
+
+// return a configmap in the namespace monitoring
+func configMap(name string, version string, annotations map[string]string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "monitoring",
+			Name:            name,
+			SelfLink:        "/api/v1/namespaces/monitoring/configmaps/" + name,
+			ResourceVersion: version,
+			Annotations:     annotations,
+		},
+		Data: data,
+	}
+}
+
+// sync all queued configmaps once, failed ones are requeued with backoff and not synced again
+func syncQueued(t *testing.T, c *Controller) {
+	for c.queue.Len() > 0 {
+		c.processNextItem()
+	}
+}
+
+// return the dashboards of the default organization by title
+func dashboards(t *testing.T, g *grafana.MemoryClient) map[string]grafana.SearchHit {
+	hits, err := g.SearchDashboardContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]grafana.SearchHit)
+	for _, hit := range hits {
+		if hit.Type == "dash-db" {
+			result[hit.Title] = hit
+		}
+	}
+	return result
+}
+
+// return the datasources of the default organization by name
+func datasources(t *testing.T, g *grafana.MemoryClient) map[string]grafana.Datasource {
+	dss, err := g.SearchDatasourceContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]grafana.Datasource)
+	for _, ds := range dss {
+		result[ds.Name] = ds
+	}
+	return result
+}
+
+var dashboardAnnotations = map[string]string{"grafana.net/id": "0", "grafana.net/dashboard": "true"}
+
+func TestSyncCreatesDashboards(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{
+		"nodes.json": `{"title": "Nodes"}`,
+		"pods.json":  `{"title": "Pods", "tags": ["k8s"]}`,
+	}))
+	syncQueued(t, c)
+
+	dhs := dashboards(t, g)
+	if len(dhs) != 2 {
+		t.Fatalf("expected 2 dashboards, got %+v", dhs)
+	}
+	for title, hit := range dhs {
+		if tag := dashboardTag(hit.Tags); tag != (owner{Namespace: "monitoring", ConfigMap: "dashboards", Key: strings.ToLower(title) + ".json"}).tag() {
+			t.Errorf("dashboard %s is not stamped with its owner: %v", title, hit.Tags)
+		}
+	}
+	if _, ok := c.applied["monitoring/dashboards"]; !ok {
+		t.Error("configmap is not applied")
+	}
+}
+
+func TestSyncIgnoresOtherControllers(t *testing.T) {
+	c, g := newTestController(t, Config{Id: 1})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+	if len(g.Calls()) != 0 {
+		t.Fatalf("expected no calls, got %v", g.CallNames())
+	}
+}
+
+func TestSyncUpdatesDashboards(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{
+		"nodes.json": `{"title": "Nodes"}`,
+		"pods.json":  `{"title": "Pods"}`,
+	}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("dashboards", "2", dashboardAnnotations, map[string]string{
+		"nodes.json": `{"title": "Nodes", "refresh": "1m"}`,
+	}))
+	syncQueued(t, c)
+
+	dhs := dashboards(t, g)
+	if _, ok := dhs["Pods"]; ok || len(dhs) != 1 {
+		t.Fatalf("expected the dashboard of the removed key to be deleted, got %+v", dhs)
+	}
+	dh, err := g.GetDashboardContext(context.Background(), dhs["Nodes"].Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dh.Model["refresh"] != "1m" {
+		t.Fatalf("dashboard not updated: %+v", dh.Model)
+	}
+}
+
+func TestSyncDeletesDashboards(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c.Create(cm)
+	syncQueued(t, c)
+
+	c.Delete(cm)
+	syncQueued(t, c)
+	if dhs := dashboards(t, g); len(dhs) != 0 {
+		t.Fatalf("expected no dashboards, got %+v", dhs)
+	}
+	if len(c.applied) != 0 || len(c.desired) != 0 {
+		t.Fatal("deleted configmap is still known")
+	}
+}
+
+func TestSyncDeletesTombstones(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c.Create(cm)
+	syncQueued(t, c)
+
+	c.Delete(cache.DeletedFinalStateUnknown{Key: "monitoring/dashboards", Obj: cm})
+	syncQueued(t, c)
+	if dhs := dashboards(t, g); len(dhs) != 0 {
+		t.Fatalf("expected no dashboards, got %+v", dhs)
+	}
+}
+
+func TestSyncDeletesConfigMapsNotHandledAnymore(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("dashboards", "2", map[string]string{"grafana.net/id": "1", "grafana.net/dashboard": "true"}, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+	if dhs := dashboards(t, g); len(dhs) != 0 {
+		t.Fatalf("expected no dashboards, got %+v", dhs)
+	}
+}
+
+func TestStatusOnlyUpdatesAreSkipped(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+	g.ResetCalls()
+
+	annotations := map[string]string{statusAnnotation: statusSynced, lastSyncedAnnotation: "2019-05-01T00:00:00Z"}
+	for k, v := range dashboardAnnotations {
+		annotations[k] = v
+	}
+	c.Update(nil, configMap("dashboards", "2", annotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	if n := c.queue.Len(); n != 0 {
+		t.Fatalf("expected nothing queued, got %d", n)
+	}
+	syncQueued(t, c)
+	if len(g.Calls()) != 0 {
+		t.Fatalf("expected no calls, got %v", g.CallNames())
+	}
+}
+
+func TestSyncRetriesFailedConfigMaps(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	g.Errors["CreateDashboard"] = &grafana.APIError{StatusCode: 500, Message: "database is locked"}
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+	if _, ok := c.applied["monitoring/dashboards"]; ok {
+		t.Fatal("failed configmap is applied")
+	}
+	if n := c.queue.NumRequeues("monitoring/dashboards"); n != 1 {
+		t.Fatalf("expected the configmap to be requeued once, got %d", n)
+	}
+
+	delete(g.Errors, "CreateDashboard")
+	if err := c.sync("monitoring/dashboards"); err != nil {
+		t.Fatal(err)
+	}
+	if dhs := dashboards(t, g); len(dhs) != 1 {
+		t.Fatalf("expected 1 dashboard, got %+v", dhs)
+	}
+}
+
+func TestSyncRepairsDrift(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{
+		"nodes.json": `{"title": "Nodes", "refresh": "1m"}`,
+		"pods.json":  `{"title": "Pods"}`,
+	}))
+	syncQueued(t, c)
+
+	dhs := dashboards(t, g)
+	ctx := context.Background()
+	if err := g.DeleteDashboardContext(ctx, dhs["Pods"].Uid); err != nil {
+		t.Fatal(err)
+	}
+	dh, _ := g.GetDashboardContext(ctx, dhs["Nodes"].Uid)
+	dh.Model["refresh"] = "1h"
+	if _, err := g.CreateDashboardContext(ctx, grafana.Dashboard{Model: dh.Model, Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is checked without a resync
+	if err := c.sync("monitoring/dashboards"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dashboards(t, g)["Pods"]; ok {
+		t.Fatal("drift repaired without a resync")
+	}
+
+	c.resync()
+	syncQueued(t, c)
+	dhs = dashboards(t, g)
+	if _, ok := dhs["Pods"]; !ok {
+		t.Fatalf("deleted dashboard not recreated: %+v", dhs)
+	}
+	dh, _ = g.GetDashboardContext(ctx, dhs["Nodes"].Uid)
+	if dh.Model["refresh"] != "1m" {
+		t.Fatalf("changed dashboard not repaired: %+v", dh.Model)
+	}
+}
+
+func TestResyncKeepsUnchangedDashboards(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{
+		"nodes.json": `{"title": "Nodes", "tags": ["k8s"], "panels": [{"id": 1, "type": "graph"}]}`,
+	}))
+	syncQueued(t, c)
+	g.ResetCalls()
+
+	c.resync()
+	syncQueued(t, c)
+	for _, name := range g.CallNames() {
+		if name == "CreateDashboard" {
+			t.Fatalf("unchanged dashboard saved again on resync: %v", g.CallNames())
+		}
+	}
+}
+
+func TestSyncDatasources(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	annotations := map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}
+	c.Create(configMap("datasources", "1", annotations, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+	}))
+	syncQueued(t, c)
+	dss := datasources(t, g)
+	if o, stamped := parseOwner(dss["prometheus"].JsonData[ownerField]); !stamped || o.ConfigMap != "datasources" {
+		t.Fatalf("datasource not created with its owner: %+v", dss)
+	}
+
+	c.Update(nil, configMap("datasources", "2", annotations, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://thanos:9090"}`,
+	}))
+	syncQueued(t, c)
+	if dss = datasources(t, g); dss["prometheus"].Url != "http://thanos:9090" {
+		t.Fatalf("datasource not updated: %+v", dss)
+	}
+
+	c.Delete(configMap("datasources", "2", annotations, nil))
+	syncQueued(t, c)
+	if dss = datasources(t, g); len(dss) != 0 {
+		t.Fatalf("expected no datasources, got %+v", dss)
+	}
+}
+
+func TestSyncRepairsDatasources(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("datasources", "1", map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+	}))
+	syncQueued(t, c)
+
+	ds := datasources(t, g)["prometheus"]
+	ds.Url = "http://changed:9090"
+	if err := g.UpdateDatasourceContext(context.Background(), ds); err != nil {
+		t.Fatal(err)
+	}
+	c.resync()
+	syncQueued(t, c)
+	if ds = datasources(t, g)["prometheus"]; ds.Url != "http://prometheus:9090" {
+		t.Fatalf("datasource not repaired: %+v", ds)
+	}
+}
+
+func TestSyncNotificationChannels(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	annotations := map[string]string{"grafana.net/id": "0", "grafana.net/notification-channel": "true"}
+	c.Create(configMap("channels", "1", annotations, map[string]string{
+		"team.json": `{"name": "team", "type": "email", "settings": {"addresses": "team@example.com"}}`,
+	}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("channels", "2", annotations, map[string]string{
+		"team.json": `{"name": "team", "type": "email", "settings": {"addresses": "oncall@example.com"}}`,
+	}))
+	syncQueued(t, c)
+	ncs, err := g.SearchNotificationChannelContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ncs) != 1 || ncs[0].Settings["addresses"] != "oncall@example.com" {
+		t.Fatalf("notification channel not updated: %+v", ncs)
+	}
+
+	c.Delete(configMap("channels", "2", annotations, nil))
+	syncQueued(t, c)
+	if ncs, _ = g.SearchNotificationChannelContext(context.Background()); len(ncs) != 0 {
+		t.Fatalf("expected no notification channels, got %+v", ncs)
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	kept := configMap("kept", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c, g := newTestController(t, Config{GarbageCollection: GarbageCollectionReport}, kept)
+	defer c.sink.Stop()
+
+	// the controller was down while the configmap orphaned was deleted and kept was created
+	orphaned := configMap("orphaned", "1", dashboardAnnotations, map[string]string{"pods.json": `{"title": "Pods"}`})
+	if err := c.create(orphaned); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.create(kept); err != nil {
+		t.Fatal(err)
+	}
+	// objects of other controllers and without owner are never collected
+	other := New(context.Background(), g, nil, Config{Id: 1}, log.NewNopLogger())
+	if err := other.create(configMap("other", "1", map[string]string{"grafana.net/id": "1", "grafana.net/dashboard": "true"}, map[string]string{"other.json": `{"title": "Other"}`})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.CreateDashboardContext(context.Background(), grafana.Dashboard{Model: map[string]interface{}{"title": "Manual"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if dhs := dashboards(t, g); len(dhs) != 4 {
+		t.Fatalf("expected orphans to be reported only, got %+v", dhs)
+	}
+
+	c.config.GarbageCollection = GarbageCollectionDelete
+	if err := c.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	dhs := dashboards(t, g)
+	if _, ok := dhs["Pods"]; ok || len(dhs) != 3 {
+		t.Fatalf("expected only the orphaned dashboard to be deleted, got %+v", dhs)
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	for annotations, expected := range map[string]kind{
+		"":                                   kindNone,
+		"grafana.net/dashboard=false":        kindNone,
+		"grafana.net/dashboard=true":         kindDashboard,
+		"grafana.net/datasource=1":           kindDatasource,
+		"grafana.net/library-panel=true":     kindLibraryPanel,
+		"grafana.net/notification-channel=t": kindNotificationChannel,
+		"grafana.net/mute-timing=true":       kindMuteTiming,
+		// a datasource takes precedence over other kinds
+		"grafana.net/dashboard=true,grafana.net/datasource=true": kindDatasource,
+	} {
+		cm := configMap("cm", "1", map[string]string{}, nil)
+		for _, annotation := range strings.Split(annotations, ",") {
+			if parts := strings.SplitN(annotation, "=", 2); len(parts) == 2 {
+				cm.Annotations[parts[0]] = parts[1]
+			}
+		}
+		if k := kindOf(cm); k != expected {
+			t.Errorf("%q: expected %v, got %v", annotations, expected, k)
+		}
+	}
+}
+
+func TestUnifiedAlertingNeedsProvisioningAPI(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	reported := grafana.NewCapabilities("8.5.2")
+	reported.UnifiedAlerting, reported.LegacyAlerting = true, false
+	g.SetCapabilities(reported)
+	if _, err := g.DetectCapabilitiesContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	g.ResetCalls()
+
+	for _, annotation := range []string{"alert-rule", "contact-point", "notification-policy", "mute-timing", "notification-template"} {
+		cm := configMap(annotation, "1", map[string]string{"grafana.net/id": "0", "grafana.net/" + annotation: "true"}, map[string]string{"key": "{}"})
+		if err := c.checkCapabilities(cm); err == nil {
+			t.Errorf("%s is not refused by Grafana 8", annotation)
+		}
+		c.Create(cm)
+	}
+	syncQueued(t, c)
+	if len(g.Calls()) != 0 {
+		t.Fatalf("expected no calls, got %v", g.CallNames())
+	}
+}
+
+func TestUndetectedCapabilitiesAreDetectedOnResync(t *testing.T) {
+	cm := configMap("timings", "1", muteTimingAnnotations, map[string]string{"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday]"})
+	c, g := newTestController(t, Config{})
+	reported := grafana.NewCapabilities("9.3.0")
+	reported.UnifiedAlerting, reported.LegacyAlerting = true, false
+	g.SetCapabilities(reported)
+	g.Errors["DetectCapabilities"] = &grafana.APIError{StatusCode: 503, Message: "Grafana is starting"}
+
+	// as long as the version is not detected only the api of grafana 5 and 6 is assumed
+	c.resync()
+	c.Create(cm)
+	syncQueued(t, c)
+	if err := c.checkCapabilities(cm); err == nil {
+		t.Fatal("mute timing accepted by an undetected Grafana")
+	}
+	if live, _ := g.SearchMuteTimingsContext(context.Background()); len(live) != 0 {
+		t.Fatalf("mute timing created in an undetected Grafana: %+v", live)
+	}
+
+	delete(g.Errors, "DetectCapabilities")
+	c.resync()
+	syncQueued(t, c)
+	if caps := g.Capabilities(); caps == nil || caps.Version != "9.3.0" {
+		t.Fatalf("capabilities not detected on resync: %+v", caps)
+	}
+	if live, _ := g.SearchMuteTimingsContext(context.Background()); len(live) != 1 {
+		t.Fatalf("mute timing not created once Grafana was detected: %+v", live)
+	}
+}
+
+func TestSyncSwitchesKinds(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("objects", "1", dashboardAnnotations, map[string]string{"prometheus.json": `{"title": "Prometheus"}`}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("objects", "2", map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+	}))
+	syncQueued(t, c)
+	if dhs := dashboards(t, g); len(dhs) != 0 {
+		t.Fatalf("expected the dashboard to be deleted, got %+v", dhs)
+	}
+	if dss := datasources(t, g); len(dss) != 1 {
+		t.Fatalf("expected the datasource to be created, got %+v", dss)
+	}
+}
+
+func TestUpdateDeletesRemovedAndRenamedDatasources(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	annotations := map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}
+	c.Create(configMap("datasources", "1", annotations, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+		"loki.json":       `{"name": "loki", "type": "loki", "access": "proxy", "url": "http://loki:3100"}`,
+	}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("datasources", "2", annotations, map[string]string{
+		"prometheus.json": `{"name": "thanos", "type": "prometheus", "access": "proxy", "url": "http://thanos:9090"}`,
+	}))
+	syncQueued(t, c)
+	dss := datasources(t, g)
+	if _, ok := dss["thanos"]; !ok || len(dss) != 1 {
+		t.Fatalf("expected only the renamed datasource, got %+v", dss)
+	}
+}
+
+func TestUpdateDeletesRemovedAndRenamedNotificationChannels(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	annotations := map[string]string{"grafana.net/id": "0", "grafana.net/notification-channel": "true"}
+	c.Create(configMap("channels", "1", annotations, map[string]string{
+		"team.json":   `{"name": "team", "type": "email", "settings": {"addresses": "team@example.com"}}`,
+		"oncall.json": `{"name": "oncall", "type": "email", "settings": {"addresses": "oncall@example.com"}}`,
+	}))
+	syncQueued(t, c)
+
+	c.Update(nil, configMap("channels", "2", annotations, map[string]string{
+		"team.json": `{"name": "platform", "type": "email", "settings": {"addresses": "team@example.com"}}`,
+	}))
+	syncQueued(t, c)
+	ncs, err := g.SearchNotificationChannelContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ncs) != 1 || ncs[0].Name != "platform" {
+		t.Fatalf("expected only the renamed notification channel, got %+v", ncs)
+	}
+}
+
+func TestUpdateKeepsUnchangedEntries(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	annotations := map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}
+	c.Create(configMap("datasources", "1", annotations, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+		"loki.json":       `{"name": "loki", "type": "loki", "access": "proxy", "url": "http://loki:3100"}`,
+	}))
+	syncQueued(t, c)
+	g.ResetCalls()
+
+	c.Update(nil, configMap("datasources", "2", annotations, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://thanos:9090"}`,
+		"loki.json":       `{"name": "loki", "type": "loki", "access": "proxy", "url": "http://loki:3100"}`,
+	}))
+	syncQueued(t, c)
+	updated := 0
+	for _, call := range g.Calls() {
+		if call.Method == "UpdateDatasource" {
+			if name := call.Args[0].(grafana.Datasource).Name; name != "prometheus" {
+				t.Fatalf("unchanged datasource %s was updated", name)
+			}
+			updated++
+		}
+	}
+	if updated != 1 {
+		t.Fatalf("expected 1 update, got %d", updated)
+	}
+}
+
+// return the annotations of a configmap in the fake kubernetes of a controller
+func storedAnnotations(t *testing.T, c *Controller, name string) map[string]string {
+	cm, err := c.kclient.CoreV1().ConfigMaps("monitoring").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm.Annotations
+}
+
+func TestResyncedConfigMapsKeepTheirStatus(t *testing.T) {
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c, g := newTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+	c.Create(cm)
+	syncQueued(t, c)
+
+	// the status patch comes back from the informer as a new revision
+	stored, err := c.kclient.CoreV1().ConfigMaps("monitoring").Get("dashboards", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.ResourceVersion = "2"
+	c.Update(cm, stored)
+	syncQueued(t, c)
+
+	// the informer resyncs the same revision
+	g.ResetCalls()
+	c.kclient.(*fake.Clientset).ClearActions()
+	c.Update(stored, stored)
+	syncQueued(t, c)
+	if calls := g.CallNames(); len(calls) != 0 {
+		t.Fatalf("expected no calls for an unchanged revision, got %v", calls)
+	}
+	for _, action := range c.kclient.(*fake.Clientset).Actions() {
+		if action.Matches("patch", "configmaps") {
+			t.Fatal("status of an unchanged revision patched again")
+		}
+	}
+
+	// a failed drift check of the same revision is written
+	g.Errors["SearchDashboard"] = &grafana.APIError{StatusCode: 500, Message: "database is locked"}
+	c.resync()
+	syncQueued(t, c)
+	if annotations := storedAnnotations(t, c, "dashboards"); annotations[statusAnnotation] != statusFailed {
+		t.Fatalf("expected the status Failed, got %v", annotations)
+	}
+}
+
+func TestUnsupportedConfigMapsAreNotRetried(t *testing.T) {
+	cm := configMap("timings", "1", map[string]string{"grafana.net/id": "0", "grafana.net/mute-timing": "true"}, map[string]string{
+		"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday, sunday]",
+	})
+	c, g := newTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+	// the default grafana of the memory client has no unified alerting
+	if _, err := g.DetectCapabilitiesContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Create(cm)
+	syncQueued(t, c)
+	if n := c.queue.NumRequeues("monitoring/timings"); n != 0 {
+		t.Fatalf("expected the configmap not to be requeued, got %d requeues", n)
+	}
+	if _, ok := c.applied["monitoring/timings"]; ok {
+		t.Fatal("unsupported configmap is applied")
+	}
+	annotations := storedAnnotations(t, c, "timings")
+	if annotations[statusAnnotation] != statusUnsupported || !strings.Contains(annotations[lastErrorAnnotation], "unified alerting") {
+		t.Fatalf("expected the status Unsupported with the error, got %v", annotations)
+	}
+	if _, ok := annotations[lastSyncedAnnotation]; ok {
+		t.Fatalf("unsupported configmap is marked synced: %v", annotations)
+	}
+}
+
+func TestFailedConfigMapsGetStatus(t *testing.T) {
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c, g := newTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+
+	g.Errors["CreateDashboard"] = &grafana.APIError{StatusCode: 500, Message: "database is locked"}
+	c.Create(cm)
+	syncQueued(t, c)
+	annotations := storedAnnotations(t, c, "dashboards")
+	if annotations[statusAnnotation] != statusFailed || !strings.Contains(annotations[lastErrorAnnotation], "database is locked") {
+		t.Fatalf("expected the status Failed with the error, got %v", annotations)
+	}
+
+	delete(g.Errors, "CreateDashboard")
+	if err := c.sync("monitoring/dashboards"); err != nil {
+		t.Fatal(err)
+	}
+	annotations = storedAnnotations(t, c, "dashboards")
+	if annotations[statusAnnotation] != statusSynced || annotations[lastSyncedAnnotation] == "" || annotations[dashboardUidsAnnotation] == "" {
+		t.Fatalf("expected the status Synced, got %v", annotations)
+	}
+	// the fake kubernetes keeps annotations removed by a merge patch, so the patch itself is checked
+	var patch string
+	for _, action := range c.kclient.(*fake.Clientset).Actions() {
+		if action.Matches("patch", "configmaps") {
+			patch = string(action.(k8stesting.PatchAction).GetPatch())
+		}
+	}
+	if !strings.Contains(patch, `"`+lastErrorAnnotation+`":null`) {
+		t.Fatalf("last error is not removed by %s", patch)
+	}
+}
+
+func TestOwnershipConflictsAreNotRetried(t *testing.T) {
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c, g := newTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+	if _, err := g.CreateDashboardContext(context.Background(), grafana.Dashboard{Model: map[string]interface{}{"title": "Nodes", "uid": "manual"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Create(cm)
+	syncQueued(t, c)
+	if n := c.queue.NumRequeues("monitoring/dashboards"); n != 0 {
+		t.Fatalf("expected the configmap not to be requeued, got %d requeues", n)
+	}
+	annotations := storedAnnotations(t, c, "dashboards")
+	if annotations[statusAnnotation] != statusFailed || annotations[lastErrorAnnotation] == "" {
+		t.Fatalf("expected the status Failed with the error, got %v", annotations)
+	}
+	if dhs := dashboards(t, g); dhs["Nodes"].Uid != "manual" {
+		t.Fatalf("manual dashboard was replaced: %+v", dhs)
+	}
+}
+
+func TestWorseKeepsRetryableErrors(t *testing.T) {
+	transient := &grafana.APIError{StatusCode: 503}
+	conflict := permanent(&grafana.APIError{StatusCode: 412})
+	if err := worse(transient, conflict); err != transient {
+		t.Fatalf("expected the retryable error, got %v", err)
+	}
+	if err := worse(conflict, transient); err != transient {
+		t.Fatalf("expected the retryable error, got %v", err)
+	}
+	if err := worse(nil, conflict); err != conflict {
+		t.Fatalf("expected the permanent error, got %v", err)
+	}
+}
+
+func TestExactMatchesAreAdopted(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	ctx := context.Background()
+	if _, err := g.CreateDashboardContext(ctx, grafana.Dashboard{Model: map[string]interface{}{"title": "Nodes", "uid": "nodes"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateDatasourceContext(ctx, grafana.Datasource{Name: "prometheus", Type: "prometheus", Url: "http://prometheus:9090"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes", "uid": "nodes"}`}))
+	c.Create(configMap("datasources", "1", map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://thanos:9090"}`,
+	}))
+	syncQueued(t, c)
+	dhs := dashboards(t, g)
+	if dashboardTag(dhs["Nodes"].Tags) != (owner{Namespace: "monitoring", ConfigMap: "dashboards", Key: "nodes.json"}).tag() || len(dhs) != 1 {
+		t.Fatalf("dashboard not adopted: %+v", dhs)
+	}
+	dss := datasources(t, g)
+	if o, stamped := parseOwner(dss["prometheus"].JsonData[ownerField]); !stamped || o.ConfigMap != "datasources" || dss["prometheus"].Url != "http://thanos:9090" {
+		t.Fatalf("datasource not adopted: %+v", dss)
+	}
+}
+
+func TestInexactMatchesAreNotAdopted(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	if err := g.CreateDatasourceContext(context.Background(), grafana.Datasource{Name: "prometheus", Type: "loki"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Create(configMap("datasources", "1", map[string]string{"grafana.net/id": "0", "grafana.net/datasource": "true"}, map[string]string{
+		"prometheus.json": `{"name": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090"}`,
+	}))
+	syncQueued(t, c)
+	if _, ok := c.applied["monitoring/datasources"]; ok {
+		t.Fatal("configmap conflicting with a datasource of another type is applied")
+	}
+	if dss := datasources(t, g); dss["prometheus"].Type != "loki" {
+		t.Fatalf("datasource of another type was replaced: %+v", dss)
+	}
+}
+
+func TestOwnerTagFitsGrafanaTags(t *testing.T) {
+	o := owner{Id: 12, Namespace: "a-rather-long-namespace-name", ConfigMap: "a-rather-long-configmap-name", Key: "a-rather-long-dashboard-key.json"}
+	tag := o.tag()
+	if len(tag) > 50 || !strings.HasPrefix(tag, "gcc:12:") {
+		t.Fatalf("expected a short tag, got %s", tag)
+	}
+	other := o
+	other.Key = "another-dashboard-key.json"
+	if other.tag() == tag {
+		t.Fatalf("expected different tags for different entries, got %s", tag)
+	}
+}
+
+func TestDashboardsCarryTheirFullOwner(t *testing.T) {
+	c, g := newTestController(t, Config{})
+	c.Create(configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`}))
+	syncQueued(t, c)
+	dh, err := g.GetDashboardContext(context.Background(), dashboards(t, g)["Nodes"].Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, stamped := parseOwner(dh.Model[ownerField]); !stamped || o != c.owner(c.applied["monitoring/dashboards"], "nodes.json") {
+		t.Fatalf("dashboard json does not name its owner: %v", dh.Model[ownerField])
+	}
+}
+
+func TestGarbageCollectionSearchesAllOrgs(t *testing.T) {
+	c, g := newTestController(t, Config{GarbageCollection: GarbageCollectionDelete, CreateOrgs: true}, configMap("unrelated", "1", nil, nil))
+	defer c.sink.Stop()
+	// the configmap was deleted while the controller was down, so no configmap names the organization
+	orphaned := configMap("orphaned", "1", map[string]string{"grafana.net/id": "0", "grafana.net/dashboard": "true", "grafana.net/org": "team"}, map[string]string{"pods.json": `{"title": "Pods"}`})
+	if err := c.create(orphaned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	org, err := g.GetOrgByNameContext(context.Background(), "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits, err := g.SearchDashboardContext(grafana.WithOrgId(context.Background(), org.Id)); err != nil || len(hits) != 0 {
+		t.Fatalf("expected the orphan in organization team to be deleted, got %+v, %v", hits, err)
+	}
+}
+
+func TestRunWaitsForSyncBeforeGarbageCollection(t *testing.T) {
+	c, g := newTestController(t, Config{GarbageCollection: GarbageCollectionReport}, configMap("unrelated", "1", nil, nil))
+	synced := make(chan struct{})
+	hasSynced := func() bool {
+		select {
+		case <-synced:
+			return true
+		default:
+			return false
+		}
+	}
+	collected := func() bool {
+		for _, name := range g.CallNames() {
+			if name == "SearchDashboard" {
+				return true
+			}
+		}
+		return false
+	}
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go c.Run(stop, wg, hasSynced)
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if collected() {
+		t.Fatal("garbage collected before the informer synced")
+	}
+	close(synced)
+	for deadline := time.Now().Add(5 * time.Second); !collected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("garbage not collected after the informer synced")
+		}
+	}
+}
+
+// return a controller syncing to a MemoryClient reporting grafana 9 with unified alerting
+func newAlertingTestController(t *testing.T, config Config, objs ...runtime.Object) (*Controller, *grafana.MemoryClient) {
+	c, g := newTestController(t, config, objs...)
+	reported := grafana.NewCapabilities("9.3.0")
+	reported.UnifiedAlerting, reported.LegacyAlerting = true, false
+	g.SetCapabilities(reported)
+	if _, err := g.DetectCapabilitiesContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c, g
+}
+
+// return a controller syncing through the http api of a grafanatest server, which reports grafana 9.3 with unified alerting
+// and answers with the status codes of grafana
+func newServerTestController(t *testing.T, config Config, objs ...runtime.Object) (*Controller, *grafanatest.Server) {
+	s := grafanatest.NewServer()
+	reported := grafana.NewCapabilities("9.3.0")
+	reported.UnifiedAlerting, reported.LegacyAlerting = true, false
+	s.Grafana.SetCapabilities(reported)
+	g := s.APIClient(log.NewNopLogger())
+	if _, err := g.DetectCapabilities(); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := newTestController(t, config, objs...)
+	c.g = g
+	return c, s
+}
+
+var muteTimingAnnotations = map[string]string{"grafana.net/id": "0", "grafana.net/mute-timing": "true"}
+
+func TestMuteTimingsNotCreatedAreKept(t *testing.T) {
+	cm := configMap("timings", "1", muteTimingAnnotations, map[string]string{"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday]"})
+	c, g := newAlertingTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+	manual := grafana.MuteTiming{Name: "weekends", TimeIntervals: []map[string]interface{}{{"weekdays": []interface{}{"sunday"}}}}
+	if err := g.CreateMuteTimingContext(context.Background(), manual); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Create(cm)
+	syncQueued(t, c)
+	annotations := storedAnnotations(t, c, "timings")
+	if annotations[statusAnnotation] != statusFailed || annotations[muteTimingsAnnotation] != "" {
+		t.Fatalf("expected the status Failed without created mute timings, got %v", annotations)
+	}
+	c.Delete(cm)
+	syncQueued(t, c)
+	live, err := g.SearchMuteTimingsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].TimeIntervals[0]["weekdays"].([]interface{})[0] != "sunday" {
+		t.Fatalf("mute timing not created from the configmap was changed: %+v", live)
+	}
+}
+
+func TestMuteTimingsCreatedAreRecorded(t *testing.T) {
+	cm := configMap("timings", "1", muteTimingAnnotations, map[string]string{"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday]"})
+	c, g := newAlertingTestController(t, Config{}, cm)
+	defer c.sink.Stop()
+
+	c.Create(cm)
+	syncQueued(t, c)
+	if annotations := storedAnnotations(t, c, "timings"); annotations[muteTimingsAnnotation] != "weekends" {
+		t.Fatalf("expected the created mute timing to be recorded, got %v", annotations)
+	}
+
+	// a restarted controller knows the mute timing from the annotation
+	restarted, _ := newTestController(t, Config{})
+	restarted.g = g
+	cm = configMap("timings", "2", map[string]string{"grafana.net/id": "0", "grafana.net/mute-timing": "true", muteTimingsAnnotation: "weekends"}, cm.Data)
+	if err := restarted.delete(cm); err != nil {
+		t.Fatal(err)
+	}
+	if live, err := g.SearchMuteTimingsContext(context.Background()); err != nil || len(live) != 0 {
+		t.Fatalf("expected the mute timing to be deleted, got %+v, %v", live, err)
+	}
+}
+
+func TestDryRunPlansChanges(t *testing.T) {
+	cm := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes"}`})
+	c, g := newTestController(t, Config{DryRun: true}, cm)
+	defer c.sink.Stop()
+	c.g = grafana.NewDryRunClient(g, log.NewNopLogger())
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	c.Create(cm)
+	syncQueued(t, c)
+	if dhs := dashboards(t, g); len(dhs) != 0 {
+		t.Fatalf("dry run changed grafana: %+v", dhs)
+	}
+	annotations := storedAnnotations(t, c, "dashboards")
+	if annotations[statusAnnotation] != statusPlanned {
+		t.Fatalf("expected the status Planned, got %v", annotations)
+	}
+	if _, ok := annotations[lastSyncedAnnotation]; ok {
+		t.Fatalf("planned configmap is marked synced: %v", annotations)
+	}
+	if event := <-recorder.Events; event != "Normal PlannedCreate Planned to create dashboard nodes.json" {
+		t.Fatalf("expected a planned event, got %s", event)
+	}
+}
+
+func TestDryRunRedactsSettings(t *testing.T) {
+	cm := configMap("contacts", "1", map[string]string{"grafana.net/id": "0", "grafana.net/contact-point": "true"},
+		map[string]string{"slack.yaml": "name: team\ntype: slack\nsettings:\n  url: https://hooks.slack.com/services/secret-path\n  title: Alerts"})
+	c, g := newAlertingTestController(t, Config{DryRun: true})
+	var logs bytes.Buffer
+	c.g = grafana.NewDryRunClient(g, log.NewLogfmtLogger(&logs))
+
+	if err := c.create(cm); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "secret-path") {
+		t.Fatalf("dry run logged the url of a contact point: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "Alerts") {
+		t.Fatalf("dry run did not log the public settings of a contact point: %s", logs.String())
+	}
+
+	// notification channels of legacy alerting have the same settings
+	nc := configMap("channels", "1", map[string]string{"grafana.net/id": "0", "grafana.net/notification-channel": "true"},
+		map[string]string{"webhook.json": `{"name": "webhook", "type": "webhook", "settings": {"url": "https://alerts.example.com/secret-path", "username": "grafana", "password": "secret-password"}}`})
+	c, g = newTestController(t, Config{DryRun: true})
+	logs.Reset()
+	c.g = grafana.NewDryRunClient(g, log.NewLogfmtLogger(&logs))
+	if err := c.create(nc); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "secret-") || !strings.Contains(logs.String(), `settings.username=\"grafana\"`) {
+		t.Fatalf("dry run did not redact the secret settings of a notification channel: %s", logs.String())
+	}
+}
+
+func TestDryRunPlansOrganizationsAndFolders(t *testing.T) {
+	cm := configMap("dashboards", "1", map[string]string{"grafana.net/id": "0", "grafana.net/dashboard": "true", "grafana.net/org": "team", "grafana.net/folder": "Ops"},
+		map[string]string{"nodes.json": `{"title": "Nodes"}`, "pods.json": `{"title": "Pods"}`})
+	c, g := newTestController(t, Config{DryRun: true, CreateOrgs: true}, cm)
+	defer c.sink.Stop()
+	dryRun := grafana.NewDryRunClient(g, log.NewNopLogger())
+	c.g = dryRun
+
+	ctx, err := c.orgContext(cm, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orgId, _ := grafana.OrgIdFromContext(ctx); orgId >= 0 {
+		t.Fatalf("expected a placeholder id of the planned organization, got %d", orgId)
+	}
+	folder, err := c.searchFolder(ctx, "Ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.Id >= 0 || !strings.HasPrefix(folder.Uid, "planned-") {
+		t.Fatalf("expected a placeholder id and uid of the planned folder, got %+v", folder)
+	}
+
+	c.Create(cm)
+	syncQueued(t, c)
+	if annotations := storedAnnotations(t, c, "dashboards"); annotations[statusAnnotation] != statusPlanned {
+		t.Fatalf("expected the status Planned, got %v", annotations)
+	}
+	for _, call := range g.Calls() {
+		if call.OrgId < 0 {
+			t.Fatalf("planned organization was read from grafana: %+v", call)
+		}
+	}
+	if _, err := g.GetOrgByNameContext(context.Background(), "team"); !grafana.IsNotFound(err) {
+		t.Fatalf("dry run created the organization: %v", err)
+	}
+}
+
+func TestPoliciesAreUpdatedThroughTheAPI(t *testing.T) {
+	cm := configMap("routes", "1", map[string]string{"grafana.net/id": "0", "grafana.net/notification-policy": "true"}, map[string]string{"team.yaml": "receiver: team"})
+	c, s := newServerTestController(t, Config{NamespaceLabel: "namespace"})
+	defer s.Close()
+
+	c.Create(cm)
+	syncQueued(t, c)
+	tree, err := s.Grafana.GetPolicyTreeContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Routes) != 1 || tree.Routes[0].Receiver != "team" || tree.Routes[0].ObjectMatchers[0][2] != "monitoring" {
+		t.Fatalf("expected the route of the configmap, got %+v", tree.Routes)
+	}
+
+	c.Update(cm, configMap("routes", "2", cm.Annotations, map[string]string{"team.yaml": "receiver: oncall"}))
+	syncQueued(t, c)
+	if tree, err = s.Grafana.GetPolicyTreeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Routes) != 1 || tree.Routes[0].Receiver != "oncall" {
+		t.Fatalf("expected the route to be updated, got %+v", tree.Routes)
+	}
+
+	c.Delete(cm)
+	syncQueued(t, c)
+	if tree, err = s.Grafana.GetPolicyTreeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Routes) != 0 {
+		t.Fatalf("expected the route to be removed, got %+v", tree.Routes)
+	}
+}
+
+var templateAnnotations = map[string]string{"grafana.net/id": "0", "grafana.net/notification-template": "true"}
+
+// return the notification templates of the default organization by name
+func templates(t *testing.T, g grafana.Client) map[string]grafana.NotificationTemplate {
+	live, err := g.SearchNotificationTemplatesContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]grafana.NotificationTemplate)
+	for _, template := range live {
+		result[template.Name] = template
+	}
+	return result
+}
+
+func TestTemplatesAreSavedUpdatedAndDeleted(t *testing.T) {
+	cm := configMap("templates", "1", templateAnnotations, map[string]string{"alerts.tmpl": `{{ define "alerts" }}firing{{ end }}`})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+
+	c.Create(cm)
+	syncQueued(t, c)
+	template, ok := templates(t, s.Grafana)["alerts"]
+	if !ok {
+		t.Fatal("template not created")
+	}
+	if o, stamped := templateOwner(template); !stamped || o != c.owner(cm, "alerts.tmpl") {
+		t.Fatalf("template not stamped with its owner in the first line: %q", template.Template)
+	}
+	if !strings.HasSuffix(template.Template, "\n"+cm.Data["alerts.tmpl"]) {
+		t.Fatalf("unexpected template %q", template.Template)
+	}
+
+	updated := configMap("templates", "2", templateAnnotations, map[string]string{"alerts.tmpl": `{{ define "alerts" }}resolved{{ end }}`})
+	c.Update(cm, updated)
+	syncQueued(t, c)
+	template = templates(t, s.Grafana)["alerts"]
+	if strings.Count(template.Template, templateOwnerPrefix) != 1 || !strings.HasSuffix(template.Template, "\n"+updated.Data["alerts.tmpl"]) {
+		t.Fatalf("template not updated with a single owner comment: %q", template.Template)
+	}
+
+	c.Delete(updated)
+	syncQueued(t, c)
+	if live := templates(t, s.Grafana); len(live) != 0 {
+		t.Fatalf("template not deleted: %+v", live)
+	}
+}
+
+func TestTemplatesNotOwnedAreKept(t *testing.T) {
+	cm := configMap("templates", "1", templateAnnotations, map[string]string{"alerts.tmpl": `{{ define "alerts" }}firing{{ end }}`})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+	other := configMap("other", "1", templateAnnotations, nil)
+	manual := grafana.NotificationTemplate{Name: "alerts", Template: `{{ define "alerts" }}manual{{ end }}`}
+	c.owner(other, "alerts.tmpl").stampTemplate(&manual)
+	if err := s.Grafana.UpdateNotificationTemplateContext(context.Background(), manual); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.create(cm); !isPermanent(err) {
+		t.Fatalf("expected a permanent ownership conflict, got %v", err)
+	}
+	if err := c.delete(cm); err != nil {
+		t.Fatal(err)
+	}
+	if template := templates(t, s.Grafana)["alerts"]; template.Template != manual.Template {
+		t.Fatalf("template of another configmap was changed: %q", template.Template)
+	}
+}
+
+func TestMuteTimingsAreSavedUpdatedAndDeleted(t *testing.T) {
+	cm := configMap("timings", "1", muteTimingAnnotations, map[string]string{"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday]"})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+
+	c.Create(cm)
+	syncQueued(t, c)
+	updated := configMap("timings", "2", muteTimingAnnotations, map[string]string{"weekends.yaml": "name: weekends\ntime_intervals:\n- weekdays: [saturday, sunday]"})
+	c.Update(cm, updated)
+	syncQueued(t, c)
+	live, err := s.Grafana.SearchMuteTimingsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || len(live[0].TimeIntervals[0]["weekdays"].([]interface{})) != 2 {
+		t.Fatalf("mute timing not created and updated: %+v", live)
+	}
+
+	c.Delete(updated)
+	syncQueued(t, c)
+	if live, err = s.Grafana.SearchMuteTimingsContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 0 {
+		t.Fatalf("mute timing not deleted: %+v", live)
+	}
+}
+
+var alertRuleAnnotations = map[string]string{"grafana.net/id": "0", "grafana.net/alert-rule": "true"}
+
+// return an alert rule group entry with rules of the given titles in the folder Alerts
+func alertRuleGroupEntry(name string, titles ...string) string {
+	entry := "name: " + name + "\nfolder: Alerts\ninterval: 1m\nrules:\n"
+	for _, title := range titles {
+		entry += "- title: " + title + "\n  condition: A\n  for: 5m\n  data:\n  - refId: A\n    datasourceUid: prometheus\n    model: {expr: up == 0}\n"
+	}
+	return entry
+}
+
+// return the alert rules of the default organization by title
+func alertRules(t *testing.T, g grafana.Client) map[string]grafana.AlertRule {
+	live, err := g.SearchAlertRulesContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]grafana.AlertRule)
+	for _, rule := range live {
+		result[rule.Title] = rule
+	}
+	return result
+}
+
+func TestAlertRulesAreSavedUpdatedAndDeleted(t *testing.T) {
+	cm := configMap("rules", "1", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("nodes", "NodeDown", "NodeUnreachable")})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+
+	if err := c.create(cm); err != nil {
+		t.Fatal(err)
+	}
+	rules := alertRules(t, s.Grafana)
+	if len(rules) != 2 || rules["NodeDown"].RuleGroup != "nodes" || rules["NodeDown"].For != "5m" {
+		t.Fatalf("alert rules not created: %+v", rules)
+	}
+	if o, stamped := parseOwner(rules["NodeDown"].Annotations[ownerAnnotation]); !stamped || o != c.owner(cm, "nodes.yaml") {
+		t.Fatalf("alert rule not stamped with its owner: %+v", rules["NodeDown"].Annotations)
+	}
+
+	// a rule removed from the group is deleted with it
+	updated := configMap("rules", "2", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("nodes", "NodeDown")})
+	if err := c.update(cm, updated); err != nil {
+		t.Fatal(err)
+	}
+	if rules = alertRules(t, s.Grafana); len(rules) != 1 || rules["NodeDown"].Uid == "" {
+		t.Fatalf("expected only NodeDown to be left, got %+v", rules)
+	}
+
+	// the rules of a group removed from the entry are deleted one by one
+	renamed := configMap("rules", "3", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("hosts", "HostDown")})
+	if err := c.update(updated, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if rules = alertRules(t, s.Grafana); len(rules) != 1 || rules["HostDown"].RuleGroup != "hosts" {
+		t.Fatalf("expected the rules of the removed group to be deleted, got %+v", rules)
+	}
+
+	if err := c.delete(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if rules = alertRules(t, s.Grafana); len(rules) != 0 {
+		t.Fatalf("alert rules not deleted: %+v", rules)
+	}
+}
+
+func TestAlertRulesNotOwnedAreRefused(t *testing.T) {
+	cm := configMap("rules", "1", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("nodes", "NodeDown")})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+	// another configmap owns a rule in the same group
+	other := configMap("other", "1", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("nodes", "NodeLoad")})
+	if err := c.create(other); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.create(cm)
+	if !isPermanent(err) {
+		t.Fatalf("expected a permanent ownership conflict, got %v", err)
+	}
+	rules := alertRules(t, s.Grafana)
+	if _, created := rules["NodeDown"]; created || len(rules) != 1 {
+		t.Fatalf("group of another configmap was replaced: %+v", rules)
+	}
+	if o, _ := parseOwner(rules["NodeLoad"].Annotations[ownerAnnotation]); o != c.owner(other, "nodes.yaml") {
+		t.Fatalf("owner of the rule was changed: %+v", rules["NodeLoad"].Annotations)
+	}
+}
+
+func TestGarbageCollectionDeletesOrphanedAlertRules(t *testing.T) {
+	c, s := newServerTestController(t, Config{GarbageCollection: GarbageCollectionDelete}, configMap("unrelated", "1", nil, nil))
+	defer s.Close()
+	defer c.sink.Stop()
+	var logs bytes.Buffer
+	c.logger = log.NewLogfmtLogger(&logs)
+	// the configmap was deleted while the controller was down
+	orphaned := configMap("rules", "1", alertRuleAnnotations, map[string]string{"nodes.yaml": alertRuleGroupEntry("nodes", "NodeDown")})
+	if err := c.create(orphaned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if rules := alertRules(t, s.Grafana); len(rules) != 0 {
+		t.Fatalf("expected the orphaned alert rule to be deleted, got %+v", rules)
+	}
+	if strings.Contains(logs.String(), "Failed to delete orphaned") {
+		t.Fatalf("deleting the orphaned alert rule failed: %s", logs.String())
+	}
+}
+
+var libraryPanelAnnotations = map[string]string{"grafana.net/id": "0", "grafana.net/library-panel": "true"}
+
+// return the library panels of the default organization by uid
+func libraryPanels(t *testing.T, g grafana.Client) map[string]grafana.LibraryElement {
+	live, err := g.SearchLibraryPanelsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]grafana.LibraryElement)
+	for _, element := range live {
+		result[element.Uid] = element
+	}
+	return result
+}
+
+func TestLibraryPanelsAreUpdatedWithTheirVersion(t *testing.T) {
+	cm := configMap("panels", "1", libraryPanelAnnotations, map[string]string{"cpu.json": `{"uid": "cpu", "name": "CPU", "model": {"title": "CPU", "type": "graph"}}`})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+
+	if err := c.create(cm); err != nil {
+		t.Fatal(err)
+	}
+	element, ok := libraryPanels(t, s.Grafana)["cpu"]
+	if !ok || element.Name != "CPU" || element.Version != 1 {
+		t.Fatalf("library panel not created: %+v", element)
+	}
+	if o, stamped := parseOwner(element.Model[ownerField]); !stamped || o != c.owner(cm, "cpu.json") {
+		t.Fatalf("library panel not stamped with its owner: %+v", element.Model)
+	}
+
+	updated := configMap("panels", "2", libraryPanelAnnotations, map[string]string{"cpu.json": `{"uid": "cpu", "name": "CPU usage", "model": {"title": "CPU usage", "type": "timeseries"}}`})
+	if err := c.update(cm, updated); err != nil {
+		t.Fatal(err)
+	}
+	if element = libraryPanels(t, s.Grafana)["cpu"]; element.Name != "CPU usage" || element.Type != "timeseries" || element.Version != 2 {
+		t.Fatalf("library panel not updated: %+v", element)
+	}
+	// the update is a patch of the version it replaces
+	requests := s.Requests()
+	var patch *grafanatest.Request
+	for i := range requests {
+		if requests[i].Method == "PATCH" && requests[i].Path == "/api/library-elements/cpu" {
+			patch = &requests[i]
+		}
+	}
+	if patch == nil || !strings.Contains(string(patch.Body), `"version":1`) {
+		t.Fatalf("expected a patch of version 1, got %+v", patch)
+	}
+}
+
+func TestLibraryPanelsAreCreatedBeforeTheirDashboards(t *testing.T) {
+	panels := configMap("panels", "1", libraryPanelAnnotations, map[string]string{"cpu.json": `{"uid": "cpu", "name": "CPU", "model": {"title": "CPU", "type": "graph"}}`})
+	dashboard := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes", "panels": [{"id": 1, "libraryPanel": {"uid": "cpu", "name": "CPU"}}]}`})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+	c.Create(dashboard)
+	c.Create(panels)
+
+	// the dashboard is retried as long as the library panel it uses is not created
+	if err := c.sync("monitoring/dashboards"); err == nil {
+		t.Fatal("dashboard synced before the library panel it uses")
+	}
+	if hits := dashboards(t, s.Grafana); len(hits) != 0 {
+		t.Fatalf("dashboard created before the library panel it uses: %+v", hits)
+	}
+	if err := c.sync("monitoring/panels"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sync("monitoring/dashboards"); err != nil {
+		t.Fatal(err)
+	}
+	if hits := dashboards(t, s.Grafana); len(hits) != 1 {
+		t.Fatalf("dashboard not created after the library panel: %+v", hits)
+	}
+}
+
+func TestLibraryPanelsInUseAreRetried(t *testing.T) {
+	panels := configMap("panels", "1", libraryPanelAnnotations, map[string]string{"cpu.json": `{"uid": "cpu", "name": "CPU", "model": {"title": "CPU", "type": "graph"}}`})
+	dashboard := configMap("dashboards", "1", dashboardAnnotations, map[string]string{"nodes.json": `{"title": "Nodes", "panels": [{"id": 1, "libraryPanel": {"uid": "cpu", "name": "CPU"}}]}`})
+	c, s := newServerTestController(t, Config{})
+	defer s.Close()
+	if err := c.create(panels); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.create(dashboard); err != nil {
+		t.Fatal(err)
+	}
+
+	// grafana refuses to delete a library panel a dashboard uses, the configmap is retried until the dashboard is gone
+	err := c.delete(panels)
+	if err == nil || isPermanent(err) {
+		t.Fatalf("expected a failure to retry, got %v", err)
+	}
+	if _, ok := libraryPanels(t, s.Grafana)["cpu"]; !ok {
+		t.Fatal("library panel in use deleted")
+	}
+	if err = c.delete(dashboard); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.delete(panels); err != nil {
+		t.Fatal(err)
+	}
+	if live := libraryPanels(t, s.Grafana); len(live) != 0 {
+		t.Fatalf("library panel not deleted: %+v", live)
+	}
+}
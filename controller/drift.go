@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+)
+
+// fields of the configmap entries which grafana does not return or which are set by grafana
+var (
+	ignoredDashboardFields           = []string{"id", "uid", "version"}
+	ignoredDatasourceFields          = []string{"id", "uid", "orgId", "version", "password", "basicAuthPassword", "secureJsonData"}
+	ignoredNotificationChannelFields = []string{"id", "uid", "created", "updated", "secureSettings"}
+)
+
+// collect orphaned grafana objects on start, then check grafana for drift and orphans every interval until stopCh is closed
+func (c *Controller) resyncLoop(interval time.Duration, stopCh <-chan struct{}) {
+	if err := c.collectGarbage(); err != nil {
+		level.Info(c.logger).Log("msg", "Failed to collect orphaned Grafana objects")
+		level.Error(c.logger).Log("err", err.Error())
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			c.resync()
+			if err := c.collectGarbage(); err != nil {
+				level.Info(c.logger).Log("msg", "Failed to collect orphaned Grafana objects")
+				level.Error(c.logger).Log("err", err.Error())
+			}
+		}
+	}
+}
+
+// queue all handled configmaps to check grafana for drift
+func (c *Controller) resync() {
+	c.detectCapabilities()
+	c.mtx.Lock()
+	keys := make([]string, 0, len(c.desired))
+	for key := range c.desired {
+		c.repairs[key] = true
+		keys = append(keys, key)
+	}
+	c.mtx.Unlock()
+	level.Debug(c.logger).Log("msg", "Checking Grafana for drift", "configmaps", len(keys))
+	for _, key := range keys {
+		c.queue.Add(key)
+	}
+}
+
+// compare the objects of a configmap with the live state in grafana and re-apply what is missing or changed
+func (c *Controller) repair(configmapObj *v1.ConfigMap) error {
+	if err := c.checkCapabilities(configmapObj); err != nil {
+		return unsupported(err)
+	}
+	switch kindOf(configmapObj) {
+	case kindDatasource:
+		return c.repairDatasources(configmapObj)
+	case kindLibraryPanel:
+		return c.repairLibraryPanels(configmapObj)
+	case kindDashboard:
+		return c.repairDashboards(configmapObj)
+	case kindAlertRule:
+		return c.repairAlertRules(configmapObj)
+	case kindContactPoint:
+		return c.repairContactPoints(configmapObj)
+	case kindNotificationPolicy:
+		return c.repairPolicies(configmapObj)
+	case kindMuteTiming:
+		return c.repairMuteTimings(configmapObj)
+	case kindNotificationTemplate:
+		return c.repairTemplates(configmapObj)
+	}
+	return c.repairNotificationChannels(configmapObj)
+}
+
+// re-apply missing or changed datasources
+func (c *Controller) repairDatasources(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	dss, err := c.g.SearchDatasourceContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		var ds grafana.Datasource
+		if err = json.Unmarshal([]byte(v), &ds); err != nil {
+			continue
+		}
+		c.owner(configmapObj, k).stampDatasource(&ds)
+		if ds.Id = lookUpDatasourceId(c.ownedDatasources(dss, configmapObj), ds); ds.Id == -1 {
+			level.Info(c.logger).Log("msg", "Drift detected, datasource is missing, creating datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			ds.Id = 0
+			err = c.g.CreateDatasourceContext(ctx, ds)
+		} else if live := findDatasource(dss, ds.Id); drifted(entryFields(v), live, ignoredDatasourceFields) {
+			level.Info(c.logger).Log("msg", "Drift detected, datasource was changed, updating datasource: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.UpdateDatasourceContext(ctx, ds)
+		} else {
+			continue
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// re-apply missing or changed dashboards and their folders
+func (c *Controller) repairDashboards(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	fd, _ := configmapObj.Annotations["grafana.net/folder"]
+	if title := folderTitle(fd, configmapObj); title != "" {
+		folder, err := getFolder(ctx, c, title)
+		if err != nil {
+			return err
+		}
+		if folder == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, folder is missing: "+title, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		}
+	}
+	hits, err := c.g.SearchDashboardContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		var dh grafana.Dashboard
+		if dh, err = parseDashboard(v); err != nil {
+			continue
+		}
+		c.owner(configmapObj, k).stampDashboard(&dh)
+		if err = c.checkFolderId(ctx, fd, configmapObj, &dh); err != nil {
+			failed = c.logRepair(err, k, configmapObj, failed)
+			continue
+		}
+		dh.Overwrite = true
+		var live *grafana.Dashboard
+		if hit := lookUpDashboard(c.ownedDashboards(hits, configmapObj), dh, c.owner(configmapObj, k)); hit == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, dashboard is missing, creating dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.saveDashboard(ctx, hits, configmapObj, k, v)
+		} else if live, err = c.g.GetDashboardContext(ctx, hit.Uid); err == nil {
+			// the stamped model holds go values like the owner, it is compared as json like the live model
+			model, _ := json.Marshal(dh.Model)
+			if hit.FolderId == dh.FolderId && !drifted(entryFields(string(model)), live.Model, ignoredDashboardFields) {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "Drift detected, dashboard was changed or moved, overwriting dashboard: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.saveDashboard(ctx, hits, configmapObj, k, v)
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// re-apply missing or changed notification channels
+func (c *Controller) repairNotificationChannels(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	ncs, err := c.g.SearchNotificationChannelContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		var nc grafana.NotificationChannel
+		if err = json.Unmarshal([]byte(v), &nc); err != nil {
+			continue
+		}
+		c.owner(configmapObj, k).stampNotificationChannel(&nc)
+		if nc.Id = lookUpNotificationChannelId(c.ownedNotificationChannels(ncs, configmapObj), nc); nc.Id == -1 {
+			level.Info(c.logger).Log("msg", "Drift detected, notification channel is missing, creating notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			nc.Id = 0
+			err = c.g.CreateNotificationChannelContext(ctx, nc)
+		} else if live := findNotificationChannel(ncs, nc.Id); drifted(entryFields(v), live, ignoredNotificationChannelFields) {
+			level.Info(c.logger).Log("msg", "Drift detected, notification channel was changed, updating notification channel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.UpdateNotificationChannelContext(ctx, nc)
+		} else {
+			continue
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// log the result of a repair, return the worse of err and the previous failure, an object not owned by the configmap
+// is a permanent failure
+func (c *Controller) logRepair(err error, k string, configmapObj *v1.ConfigMap, failed error) error {
+	if grafana.IsPreconditionFailed(err) || grafana.IsConflict(err) {
+		level.Info(c.logger).Log("msg", "Failed to correct drift: "+k+", another object with the same name exists which is not owned by the configmap", "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Error(c.logger).Log("err", err.Error())
+		c.event(configmapObj, v1.EventTypeWarning, reasonDriftCorrectionFailed, "Failed to correct drift of "+kindOf(configmapObj).String()+" "+k+": "+err.Error())
+		return worse(failed, permanent(err))
+	} else if err != nil {
+		level.Info(c.logger).Log("msg", "Failed to correct drift: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Error(c.logger).Log("err", err.Error())
+		c.event(configmapObj, v1.EventTypeWarning, reasonDriftCorrectionFailed, "Failed to correct drift of "+kindOf(configmapObj).String()+" "+k+": "+err.Error())
+		return worse(failed, err)
+	}
+	level.Info(c.logger).Log("msg", "Succeeded: Corrected drift: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+	c.event(configmapObj, v1.EventTypeNormal, reasonDriftCorrected, "Corrected drift of "+kindOf(configmapObj).String()+" "+k)
+	return failed
+}
+
+// search datasource by id
+func findDatasource(datasources []grafana.Datasource, id int) *grafana.Datasource {
+	for _, ds := range datasources {
+		if ds.Id == id {
+			return &ds
+		}
+	}
+	return nil
+}
+
+// search notification channel by id
+func findNotificationChannel(notificationChannels []grafana.NotificationChannel, id int) *grafana.NotificationChannel {
+	for _, nc := range notificationChannels {
+		if nc.Id == id {
+			return &nc
+		}
+	}
+	return nil
+}
+
+// parse the fields of a configmap entry
+func entryFields(v string) map[string]interface{} {
+	var fields map[string]interface{}
+	json.Unmarshal([]byte(v), &fields)
+	return fields
+}
+
+// does the live object differ from the desired fields, only fields which are desired and not ignored are compared
+func drifted(desired map[string]interface{}, live interface{}, ignored []string) bool {
+	b, err := json.Marshal(live)
+	if err != nil {
+		return true
+	}
+	var actual map[string]interface{}
+	if err = json.Unmarshal(b, &actual); err != nil || actual == nil {
+		return true
+	}
+	compared := make(map[string]interface{}, len(desired))
+	for k, v := range desired {
+		compared[k] = v
+	}
+	for _, f := range ignored {
+		delete(compared, f)
+	}
+	return !contains(actual, compared)
+}
+
+// is every value of desired also in actual, maps may have additional keys in actual, slices are compared element-wise
+func contains(actual interface{}, desired interface{}) bool {
+	if desiredSlice, ok := desired.([]interface{}); ok {
+		actualSlice, ok := actual.([]interface{})
+		if !ok || len(actualSlice) != len(desiredSlice) {
+			return false
+		}
+		for i := range desiredSlice {
+			if !contains(actualSlice[i], desiredSlice[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	desiredMap, ok := desired.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(actual, desired)
+	}
+	actualMap, ok := actual.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k, v := range desiredMap {
+		if !contains(actualMap[k], v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package controller
+
+// permanentError is an error of a sync which retrying does not fix, e.g. an annotation the grafana version cannot honor,
+// the configmap is not requeued but synced again when it changes or on the next resync
+type permanentError struct {
+	// status is the sync status written to the configmap
+	status string
+	err    error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// return a permanent error for a configmap whose annotations the grafana version cannot honor
+func unsupported(err error) error {
+	return &permanentError{status: statusUnsupported, err: err}
+}
+
+// return a permanent error for a configmap which failed to sync
+func permanent(err error) error {
+	return &permanentError{status: statusFailed, err: err}
+}
+
+// is an error permanent, so retrying the sync does not fix it
+func isPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// return the sync status for the error of a sync
+func syncStatus(err error) string {
+	if err == nil {
+		return statusSynced
+	}
+	if e, ok := err.(*permanentError); ok {
+		return e.status
+	}
+	return statusFailed
+}
+
+// return the error of a sync which failed with err after it failed with failed before, an error retrying may fix
+// wins over a permanent one, so the configmap is still retried
+func worse(failed error, err error) error {
+	if failed == nil || (isPermanent(failed) && !isPermanent(err)) {
+		return err
+	}
+	return failed
+}
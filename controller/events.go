@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// reasons of the events recorded on configmaps
+const (
+	reasonCreated               = "Created"
+	reasonUpdated               = "Updated"
+	reasonDeleted               = "Deleted"
+	reasonDriftCorrected        = "DriftCorrected"
+	reasonCreateFailed          = "CreateFailed"
+	reasonUpdateFailed          = "UpdateFailed"
+	reasonDeleteFailed          = "DeleteFailed"
+	reasonDriftCorrectionFailed = "DriftCorrectionFailed"
+	reasonOrganizationFailed    = "OrganizationFailed"
+	reasonUnsupported           = "Unsupported"
+
+	// reasons of the events of changes which are only planned in a dry run
+	reasonPlannedCreate          = "PlannedCreate"
+	reasonPlannedUpdate          = "PlannedUpdate"
+	reasonPlannedDelete          = "PlannedDelete"
+	reasonPlannedDriftCorrection = "PlannedDriftCorrection"
+)
+
+// the planned reasons and messages of the events of changes in a dry run, by the reason of the change
+var plannedEvents = map[string]struct {
+	reason string
+	// done is the start of the message of the change, replaced by planned
+	done    string
+	planned string
+}{
+	reasonCreated:        {reasonPlannedCreate, "Created ", "Planned to create "},
+	reasonUpdated:        {reasonPlannedUpdate, "Updated ", "Planned to update "},
+	reasonDeleted:        {reasonPlannedDelete, "Deleted ", "Planned to delete "},
+	reasonDriftCorrected: {reasonPlannedDriftCorrection, "Corrected drift of ", "Planned to correct drift of "},
+}
+
+// record an event on a configmap, so kubectl describe configmap shows the outcome of its sync
+func (c *Controller) event(configmapObj *v1.ConfigMap, eventtype string, reason string, message string) {
+	if c.recorder == nil {
+		return
+	}
+	if planned, ok := plannedEvents[reason]; ok && c.config.DryRun {
+		reason = planned.reason
+		message = planned.planned + strings.TrimPrefix(message, planned.done)
+	}
+	c.recorder.Event(configmapObj, eventtype, reason, message)
+}
@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// modes of the garbage collection of orphaned grafana objects
+const (
+	// GarbageCollectionDelete deletes orphaned grafana objects
+	GarbageCollectionDelete = "delete"
+	// GarbageCollectionReport only logs orphaned grafana objects
+	GarbageCollectionReport = "report"
+	// GarbageCollectionOff disables the garbage collection
+	GarbageCollectionOff = "off"
+)
+
+// search grafana for objects owned by this controller whose configmap entry does not exist anymore,
+// e.g. because the configmap was deleted while the controller was down, and delete or report them
+func (c *Controller) collectGarbage() error {
+	if c.config.GarbageCollection == GarbageCollectionOff || c.kclient == nil {
+		return nil
+	}
+
+	// the grafana objects are searched before the sources are listed, so an object created
+	// in between always has its configmap in desired
+	orgs := c.orgContexts()
+	type found struct {
+		ctx     context.Context
+		kind    string
+		name    string
+		owner   owner
+		collect func(ctx context.Context) error
+	}
+	var orphans []found
+	caps := c.capabilities()
+	known := c.knownTags()
+	prefix := ownerTagPrefix + strconv.Itoa(c.config.Id) + ":"
+	for _, ctx := range orgs {
+		hits, err := c.g.SearchDashboardContext(ctx)
+		if grafana.IsUnauthorized(err) {
+			// a listed organization the controller is not a member of
+			orgId, _ := grafana.OrgIdFromContext(ctx)
+			level.Info(c.logger).Log("msg", "Skipping organization the controller may not access: "+strconv.Itoa(orgId))
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			uid := hit.Uid
+			tag := dashboardTag(hit.Tags)
+			if hit.Type != "dash-db" || !strings.HasPrefix(tag, prefix) {
+				continue
+			}
+			o, stamped := known[tag]
+			if !stamped {
+				if o, stamped, err = c.dashboardOwner(ctx, uid); err != nil {
+					return err
+				}
+			}
+			if stamped {
+				orphans = append(orphans, found{ctx, "dashboard", hit.Title, o, func(ctx context.Context) error {
+					return c.g.DeleteDashboardContext(ctx, uid)
+				}})
+			}
+		}
+		dss, err := c.g.SearchDatasourceContext(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ds := range dss {
+			name := ds.Name
+			if o, stamped := parseOwner(ds.JsonData[ownerField]); stamped && o.Id == c.config.Id {
+				orphans = append(orphans, found{ctx, "datasource", name, o, func(ctx context.Context) error {
+					return c.g.DeleteDatasourceContext(ctx, name)
+				}})
+			}
+		}
+		if caps.LibraryPanels {
+			elements, err := c.g.SearchLibraryPanelsContext(ctx)
+			if err != nil {
+				return err
+			}
+			for _, element := range elements {
+				uid := element.Uid
+				if o, stamped := parseOwner(element.Model[ownerField]); stamped && o.Id == c.config.Id {
+					orphans = append(orphans, found{ctx, "library panel", element.Name, o, func(ctx context.Context) error {
+						return c.g.DeleteLibraryElementContext(ctx, uid)
+					}})
+				}
+			}
+		}
+		if caps.UnifiedAlerting && caps.ProvisioningAPI {
+			rules, err := c.g.SearchAlertRulesContext(ctx)
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				uid := rule.Uid
+				if o, stamped := parseOwner(rule.Annotations[ownerAnnotation]); stamped && o.Id == c.config.Id {
+					orphans = append(orphans, found{ctx, "alert rule", rule.Title, o, func(ctx context.Context) error {
+						return c.g.DeleteAlertRuleContext(ctx, uid)
+					}})
+				}
+			}
+			contactPoints, err := c.g.SearchContactPointsContext(ctx)
+			if err != nil {
+				return err
+			}
+			for _, contactPoint := range contactPoints {
+				uid := contactPoint.Uid
+				if o, stamped := parseOwner(contactPoint.Settings[ownerField]); stamped && o.Id == c.config.Id {
+					orphans = append(orphans, found{ctx, "contact point", contactPoint.Name, o, func(ctx context.Context) error {
+						return c.g.DeleteContactPointContext(ctx, uid)
+					}})
+				}
+			}
+			templates, err := c.g.SearchNotificationTemplatesContext(ctx)
+			if err != nil {
+				return err
+			}
+			for _, template := range templates {
+				name := template.Name
+				if o, stamped := templateOwner(template); stamped && o.Id == c.config.Id {
+					orphans = append(orphans, found{ctx, "notification template", name, o, func(ctx context.Context) error {
+						return c.g.DeleteNotificationTemplateContext(ctx, name)
+					}})
+				}
+			}
+			tree, err := c.g.GetPolicyTreeContext(ctx)
+			if err != nil {
+				return err
+			}
+			for _, route := range tree.Routes {
+				if o, stamped := routeOwner(route); stamped && o.Id == c.config.Id {
+					orphans = append(orphans, found{ctx, "notification policy", o.Namespace + "/" + o.ConfigMap + "/" + o.Key, o, func(ctx context.Context) error {
+						return c.removeRoutes(ctx, o)
+					}})
+				}
+			}
+		}
+		if !caps.LegacyAlerting {
+			continue
+		}
+		ncs, err := c.g.SearchNotificationChannelContext(ctx)
+		if err != nil {
+			return err
+		}
+		for _, nc := range ncs {
+			id := nc.Id
+			if o, stamped := parseOwner(nc.Settings[ownerField]); stamped && o.Id == c.config.Id {
+				orphans = append(orphans, found{ctx, "notification channel", nc.Name, o, func(ctx context.Context) error {
+					return c.g.DeleteNotificationChannelContext(ctx, id)
+				}})
+			}
+		}
+	}
+
+	sources, err := c.sources()
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphans {
+		if sources[orphan.owner] {
+			continue
+		}
+		source := orphan.owner.Namespace + "/" + orphan.owner.ConfigMap + "/" + orphan.owner.Key
+		if c.config.GarbageCollection == GarbageCollectionReport {
+			level.Warn(c.logger).Log("msg", "Found orphaned "+orphan.kind+": "+orphan.name, "source", source)
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Deleting orphaned "+orphan.kind+": "+orphan.name, "source", source)
+		if err := orphan.collect(orphan.ctx); err != nil && !grafana.IsNotFound(err) {
+			level.Info(c.logger).Log("msg", "Failed to delete orphaned "+orphan.kind+": "+orphan.name, "source", source)
+			level.Error(c.logger).Log("err", err.Error())
+		} else {
+			level.Info(c.logger).Log("msg", "Succeeded: Deleted orphaned "+orphan.kind+": "+orphan.name, "source", source)
+		}
+	}
+	return nil
+}
+
+// return the owners of the entries of the configmaps known to the queue by their dashboard tag
+func (c *Controller) knownTags() map[string]owner {
+	known := make(map[string]owner)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, configmaps := range []map[string]*v1.ConfigMap{c.desired, c.applied} {
+		for _, configmapObj := range configmaps {
+			for k := range configmapObj.Data {
+				o := c.owner(configmapObj, k)
+				known[o.tag()] = o
+			}
+		}
+	}
+	return known
+}
+
+// return the owner of a dashboard stamped in its json, the tag only holds a hash of it, return false if it has none
+func (c *Controller) dashboardOwner(ctx context.Context, uid string) (owner, bool, error) {
+	dh, err := c.g.GetDashboardContext(ctx, uid)
+	if grafana.IsNotFound(err) {
+		return owner{}, false, nil
+	} else if err != nil {
+		return owner{}, false, err
+	}
+	o, stamped := parseOwner(dh.Model[ownerField])
+	return o, stamped, nil
+}
+
+// return the configmap entries handled by this controller, listed from kubernetes and known to the queue
+func (c *Controller) sources() (map[owner]bool, error) {
+	sources := make(map[owner]bool)
+	c.mtx.Lock()
+	for _, configmaps := range []map[string]*v1.ConfigMap{c.desired, c.applied} {
+		for _, configmapObj := range configmaps {
+			for k := range configmapObj.Data {
+				sources[c.owner(configmapObj, k)] = true
+			}
+		}
+	}
+	c.mtx.Unlock()
+
+	list, err := c.kclient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		configmapObj := &list.Items[i]
+		if !c.handles(configmapObj) {
+			continue
+		}
+		for k := range configmapObj.Data {
+			sources[c.owner(configmapObj, k)] = true
+		}
+	}
+	return sources, nil
+}
+
+// return a context for every organization, they are listed from grafana if the controller may create organizations,
+// which needs a server admin as listing them does, otherwise or if listing fails they are the default organization
+// and the organizations named by the configmaps known to the queue
+func (c *Controller) orgContexts() []context.Context {
+	if c.config.CreateOrgs {
+		listed, err := c.g.SearchOrgsContext(c.ctx)
+		if err == nil {
+			orgs := make(map[string]context.Context, len(listed))
+			for _, org := range listed {
+				orgs[strconv.Itoa(org.Id)] = grafana.WithOrgId(c.ctx, org.Id)
+			}
+			return contextsOf(orgs)
+		}
+		level.Info(c.logger).Log("msg", "Failed to list organizations, searching the organizations of the configmaps only")
+		level.Error(c.logger).Log("err", err.Error())
+	}
+	orgs := map[string]context.Context{"": c.ctx}
+	c.mtx.Lock()
+	configmaps := make([]*v1.ConfigMap, 0, len(c.desired)+len(c.applied))
+	for _, known := range []map[string]*v1.ConfigMap{c.desired, c.applied} {
+		for _, configmapObj := range known {
+			configmaps = append(configmaps, configmapObj)
+		}
+	}
+	c.mtx.Unlock()
+	for _, configmapObj := range configmaps {
+		ctx, err := c.orgContext(configmapObj, false)
+		if err != nil {
+			continue
+		}
+		if orgId, ok := grafana.OrgIdFromContext(ctx); ok {
+			orgs[strconv.Itoa(orgId)] = ctx
+		}
+	}
+	return contextsOf(orgs)
+}
+
+// return the contexts of a map of organizations
+func contextsOf(orgs map[string]context.Context) []context.Context {
+	contexts := make([]context.Context, 0, len(orgs))
+	for _, ctx := range orgs {
+		contexts = append(contexts, ctx)
+	}
+	return contexts
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"strconv"
+
+	"k8s.io/api/core/v1"
+)
+
+// kind of the grafana objects a configmap holds
+type kind int
+
+const (
+	kindNone kind = iota
+	kindDatasource
+	kindLibraryPanel
+	kindDashboard
+	kindAlertRule
+	kindContactPoint
+	kindNotificationPolicy
+	kindMuteTiming
+	kindNotificationTemplate
+	kindNotificationChannel
+)
+
+// the kinds with their annotation, in the order they are looked up if a configmap has several annotations
+var kinds = []struct {
+	kind       kind
+	annotation string
+	name       string
+}{
+	{kindDatasource, "grafana.net/datasource", "datasource"},
+	{kindLibraryPanel, "grafana.net/library-panel", "library panel"},
+	{kindDashboard, "grafana.net/dashboard", "dashboard"},
+	{kindAlertRule, "grafana.net/alert-rule", "alert rules"},
+	{kindContactPoint, "grafana.net/contact-point", "contact point"},
+	{kindNotificationPolicy, "grafana.net/notification-policy", "notification policy"},
+	{kindMuteTiming, "grafana.net/mute-timing", "mute timing"},
+	{kindNotificationTemplate, "grafana.net/notification-template", "notification template"},
+	{kindNotificationChannel, "grafana.net/notification-channel", "notification channel"},
+}
+
+// return the kind of a configmap given by its annotations, kindNone if it has none
+func kindOf(configmapObj *v1.ConfigMap) kind {
+	for _, k := range kinds {
+		if is, _ := strconv.ParseBool(configmapObj.Annotations[k.annotation]); is {
+			return k.kind
+		}
+	}
+	return kindNone
+}
+
+// return the annotation of a kind, e.g. grafana.net/dashboard
+func (k kind) annotation() string {
+	for _, known := range kinds {
+		if known.kind == k {
+			return known.annotation
+		}
+	}
+	return ""
+}
+
+// return the name of a kind used in events, e.g. notification channel
+func (k kind) String() string {
+	for _, known := range kinds {
+		if known.kind == k {
+			return known.name
+		}
+	}
+	return "none"
+}
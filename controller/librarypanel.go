@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// is a configmap annotated with library panels
+func isLibraryPanels(configmapObj *v1.ConfigMap) bool {
+	return kindOf(configmapObj) == kindLibraryPanel
+}
+
+// return the library panel of the entry k of a configmap in json or yaml, stamped with its owner in the model,
+// the entry is either the library element with "name" and "model" or the panel itself named by its title,
+// it gets a uid derived from namespace, configmap and key if it has none
+func (c *Controller) buildLibraryPanel(configmapObj *v1.ConfigMap, k string, v string) (grafana.LibraryElement, error) {
+	var element grafana.LibraryElement
+	data, err := yaml.YAMLToJSON([]byte(v))
+	if err != nil {
+		return element, err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(data, &m); err != nil {
+		return element, err
+	}
+	if _, ok := m["model"]; ok {
+		if err = json.Unmarshal(data, &element); err != nil {
+			return element, err
+		}
+	} else {
+		element.Model = m
+	}
+	if element.Model == nil {
+		element.Model = make(map[string]interface{})
+	}
+	if element.Name == "" {
+		element.Name, _ = element.Model["title"].(string)
+	}
+	if element.Name == "" {
+		return element, errors.New("library panel has neither name nor title")
+	}
+	o := c.owner(configmapObj, k)
+	if element.Uid == "" {
+		element.Uid = o.uid()
+	}
+	element.Id, element.OrgId, element.Version = 0, 0, 0
+	element.FolderId, element.FolderUid = 0, ""
+	element.Kind = grafana.LibraryPanelKind
+	o.stampLibraryPanel(&element)
+	return element, nil
+}
+
+// put a library panel into the folder given by grafana.net/folder, the folder is created if it does not exist
+func (c *Controller) checkLibraryPanelFolder(ctx context.Context, configmapObj *v1.ConfigMap, element *grafana.LibraryElement) error {
+	fd, _ := configmapObj.Annotations["grafana.net/folder"]
+	title := folderTitle(fd, configmapObj)
+	if title == "" {
+		return nil
+	}
+	folder, err := c.searchFolder(ctx, title)
+	if err != nil {
+		return err
+	}
+	element.FolderId = folder.Id
+	element.FolderUid = folder.Uid
+	return nil
+}
+
+// create or update the library panel of a configmap entry by its uid, a library panel created from the entry
+// before with another uid is deleted, which fails as long as dashboards still use it
+func (c *Controller) saveLibraryPanel(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	element, err := c.buildLibraryPanel(configmapObj, k, v)
+	if err != nil {
+		return err
+	}
+	if err = c.checkLibraryPanelFolder(ctx, configmapObj, &element); err != nil {
+		return err
+	}
+	live, err := c.g.SearchLibraryPanelsContext(ctx)
+	if err != nil {
+		return err
+	}
+	if existing := findLibraryPanel(live, element.Uid); existing == nil {
+		err = c.g.CreateLibraryElementContext(ctx, element)
+	} else if o, stamped := parseOwner(existing.Model[ownerField]); !c.mayAdopt(o, stamped, existing.Name == element.Name && existing.FolderUid == element.FolderUid, configmapObj) {
+		return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a library panel with the same uid which is not owned by the configmap exists"}
+	} else {
+		element.Version = existing.Version
+		err = c.g.UpdateLibraryElementContext(ctx, element)
+	}
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	for _, existing := range live {
+		if eo, stamped := parseOwner(existing.Model[ownerField]); stamped && eo == o && existing.Uid != element.Uid {
+			level.Info(c.logger).Log("msg", "Deleting library panel with previous uid: "+existing.Name, "uid", existing.Uid, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.DeleteLibraryElementContext(ctx, existing.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete the library panel created from a configmap entry, grafana refuses as long as dashboards use it,
+// so the configmap is retried until the dashboards are deleted or changed
+func (c *Controller) deleteLibraryPanel(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	element, err := c.buildLibraryPanel(configmapObj, k, configmapObj.Data[k])
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchLibraryPanelsContext(ctx)
+	if err != nil {
+		return err
+	}
+	o := c.owner(configmapObj, k)
+	deleted := false
+	for _, existing := range live {
+		eo, stamped := parseOwner(existing.Model[ownerField])
+		if (stamped && eo == o) || (existing.Uid == element.Uid && c.mayTouch(eo, stamped, configmapObj)) {
+			if err = c.g.DeleteLibraryElementContext(ctx, existing.Uid); err != nil && !grafana.IsNotFound(err) {
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "library panel not found"}
+	}
+	return nil
+}
+
+// update library panels per key: save added and changed keys and delete the library panels of removed keys
+func (c *Controller) updateLibraryPanels(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	return c.updateEntries(oldConfigmapObj, configmapObj, c.saveLibraryPanel, c.deleteLibraryPanel)
+}
+
+// re-apply missing, changed or moved library panels
+func (c *Controller) repairLibraryPanels(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchLibraryPanelsContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		element, err := c.buildLibraryPanel(configmapObj, k, v)
+		if err != nil {
+			continue
+		}
+		if err = c.checkLibraryPanelFolder(ctx, configmapObj, &element); err != nil {
+			failed = c.logRepair(err, k, configmapObj, failed)
+			continue
+		}
+		existing := findLibraryPanel(live, element.Uid)
+		if existing == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, library panel is missing, creating library panel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.CreateLibraryElementContext(ctx, element)
+		} else if existing.Name != element.Name || existing.FolderUid != element.FolderUid || libraryPanelDrifted(element, existing) {
+			if o, stamped := parseOwner(existing.Model[ownerField]); !c.mayTouch(o, stamped, configmapObj) {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "Drift detected, library panel was changed or moved, updating library panel: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			element.Version = existing.Version
+			err = c.g.UpdateLibraryElementContext(ctx, element)
+		} else {
+			continue
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// does the model of the live library panel differ from the desired one
+func libraryPanelDrifted(desired grafana.LibraryElement, live *grafana.LibraryElement) bool {
+	data, _ := json.Marshal(desired.Model)
+	return drifted(entryFields(string(data)), live.Model, nil)
+}
+
+// return an error if a dashboard uses a library panel of a handled configmap which is not synced yet,
+// the configmap of the dashboard is retried until the library panel is created
+func (c *Controller) checkLibraryPanels(configmapObj *v1.ConfigMap, dh grafana.Dashboard) error {
+	uids := dh.LibraryPanelUids()
+	if len(uids) == 0 {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, desired := range c.desired {
+		if !isLibraryPanels(desired) || desired.Annotations["grafana.net/org"] != configmapObj.Annotations["grafana.net/org"] {
+			continue
+		}
+		declared := c.libraryPanelUids(desired)
+		applied := c.libraryPanelUids(c.applied[key])
+		for _, uid := range uids {
+			if declared[uid] && !applied[uid] {
+				return errors.New("library panel " + uid + " of configmap " + key + " is not created yet")
+			}
+		}
+	}
+	return nil
+}
+
+// return the uids of the library panels of a configmap, none if it is nil or has no library panels
+func (c *Controller) libraryPanelUids(configmapObj *v1.ConfigMap) map[string]bool {
+	uids := make(map[string]bool)
+	if configmapObj == nil || !isLibraryPanels(configmapObj) {
+		return uids
+	}
+	for k, v := range configmapObj.Data {
+		if element, err := c.buildLibraryPanel(configmapObj, k, v); err == nil {
+			uids[element.Uid] = true
+		}
+	}
+	return uids
+}
+
+// search library panel by uid
+func findLibraryPanel(elements []grafana.LibraryElement, uid string) *grafana.LibraryElement {
+	for _, element := range elements {
+		if element.Uid == uid {
+			return &element
+		}
+	}
+	return nil
+}
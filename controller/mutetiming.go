@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// fields of mute timings which are set by grafana
+var ignoredMuteTimingFields = []string{"version", "provenance"}
+
+// parse the mute timing of a configmap entry in json or yaml
+func parseMuteTiming(v string) (grafana.MuteTiming, error) {
+	var muteTiming grafana.MuteTiming
+	data, err := yaml.YAMLToJSON([]byte(v))
+	if err != nil {
+		return muteTiming, err
+	}
+	if err = json.Unmarshal(data, &muteTiming); err != nil {
+		return muteTiming, err
+	}
+	if muteTiming.Name == "" {
+		return muteTiming, errors.New("mute timing without name")
+	}
+	muteTiming.Version = ""
+	muteTiming.Provenance = ""
+	return muteTiming, nil
+}
+
+// return the names of the mute timings created from a configmap, the lock has to be held
+func (c *Controller) createdMuteTimings(configmapObj *v1.ConfigMap) map[string]bool {
+	key := configmapObj.Namespace + "/" + configmapObj.Name
+	names, ok := c.muteTimings[key]
+	if !ok {
+		names = make(map[string]bool)
+		for _, name := range strings.Split(configmapObj.Annotations[muteTimingsAnnotation], ",") {
+			if name != "" {
+				names[name] = true
+			}
+		}
+		c.muteTimings[key] = names
+	}
+	return names
+}
+
+// return the sorted comma separated names of the mute timings created from a configmap
+func (c *Controller) createdMuteTimingNames(configmapObj *v1.ConfigMap) string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	names := make([]string, 0)
+	for name := range c.createdMuteTimings(configmapObj) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// may the controller update or delete the mute timing with the given name on behalf of a configmap,
+// mute timings cannot carry an owner, so only those created from the configmap are touched unless AdoptUnowned is set
+func (c *Controller) mayTouchMuteTiming(configmapObj *v1.ConfigMap, name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.config.AdoptUnowned || c.createdMuteTimings(configmapObj)[name]
+}
+
+// record that the mute timing with the given name was created from a configmap or deleted
+func (c *Controller) recordMuteTiming(configmapObj *v1.ConfigMap, name string, created bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if created {
+		c.createdMuteTimings(configmapObj)[name] = true
+	} else {
+		delete(c.createdMuteTimings(configmapObj), name)
+	}
+}
+
+// create or update the mute timing of a configmap entry by its name, an existing mute timing
+// which was not created from the configmap is not replaced
+func (c *Controller) saveMuteTiming(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	muteTiming, err := parseMuteTiming(v)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchMuteTimingsContext(ctx)
+	if err != nil {
+		return err
+	}
+	if findMuteTiming(live, muteTiming.Name) == nil {
+		err = c.g.CreateMuteTimingContext(ctx, muteTiming)
+	} else if !c.mayTouchMuteTiming(configmapObj, muteTiming.Name) {
+		return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a mute timing with the same name which was not created from the configmap exists"}
+	} else {
+		err = c.g.UpdateMuteTimingContext(ctx, muteTiming)
+	}
+	if err == nil {
+		c.recordMuteTiming(configmapObj, muteTiming.Name, true)
+	}
+	return err
+}
+
+// delete the mute timing of a configmap entry by its name, if it was created from the configmap
+func (c *Controller) deleteMuteTiming(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	muteTiming, err := parseMuteTiming(configmapObj.Data[k])
+	if err != nil {
+		return err
+	}
+	if !c.mayTouchMuteTiming(configmapObj, muteTiming.Name) {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "mute timing not found"}
+	}
+	err = c.g.DeleteMuteTimingContext(ctx, muteTiming.Name)
+	if err == nil || grafana.IsNotFound(err) {
+		c.recordMuteTiming(configmapObj, muteTiming.Name, false)
+	}
+	return err
+}
+
+// update mute timings per key: save added and changed keys and delete the mute timings of removed keys,
+// a mute timing whose name changed is deleted with its old name
+func (c *Controller) updateMuteTimings(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	failed := c.updateEntries(oldConfigmapObj, configmapObj, c.saveMuteTiming, c.deleteMuteTiming)
+	for k, v := range configmapObj.Data {
+		oldMuteTiming, oldErr := parseMuteTiming(oldConfigmapObj.Data[k])
+		muteTiming, err := parseMuteTiming(v)
+		if oldErr != nil || err != nil || oldMuteTiming.Name == muteTiming.Name {
+			continue
+		}
+		ctx, err := c.orgContext(configmapObj, false)
+		if err == nil {
+			level.Info(c.logger).Log("msg", "Deleting renamed mute timing: "+oldMuteTiming.Name, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.deleteMuteTiming(ctx, oldConfigmapObj, k)
+		}
+		if err != nil && !grafana.IsNotFound(err) {
+			level.Info(c.logger).Log("msg", "Failed to delete renamed mute timing: "+oldMuteTiming.Name, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			level.Error(c.logger).Log("err", err.Error())
+			c.event(configmapObj, v1.EventTypeWarning, reasonDeleteFailed, "Failed to delete mute timing "+oldMuteTiming.Name+": "+err.Error())
+			failed = err
+		}
+	}
+	return failed
+}
+
+// re-apply missing or changed mute timings
+func (c *Controller) repairMuteTimings(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchMuteTimingsContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		muteTiming, err := parseMuteTiming(v)
+		if err != nil {
+			continue
+		}
+		data, _ := json.Marshal(muteTiming)
+		if existing := findMuteTiming(live, muteTiming.Name); existing == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, mute timing is missing, creating mute timing: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			if err = c.g.CreateMuteTimingContext(ctx, muteTiming); err == nil {
+				c.recordMuteTiming(configmapObj, muteTiming.Name, true)
+			}
+		} else if drifted(entryFields(string(data)), existing, ignoredMuteTimingFields) {
+			if !c.mayTouchMuteTiming(configmapObj, muteTiming.Name) {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "Drift detected, mute timing was changed, updating mute timing: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+			err = c.g.UpdateMuteTimingContext(ctx, muteTiming)
+		} else {
+			continue
+		}
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// search mute timing by name
+func findMuteTiming(muteTimings []grafana.MuteTiming, name string) *grafana.MuteTiming {
+	for _, muteTiming := range muteTimings {
+		if muteTiming.Name == name {
+			return &muteTiming
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// ownerTagPrefix starts the dashboard tag naming the configmap entry a dashboard was created from
+	ownerTagPrefix = "gcc:"
+	// ownerMarkerPrefix starts the marker naming the configmap entry of notification policy routes and notification templates
+	ownerMarkerPrefix = "grafana-config-controller:"
+	// ownerField is the key in the jsonData of datasources, the settings of notification channels and contact points
+	// and the model of library panels and dashboards naming the configmap entry they were created from
+	ownerField = "grafanaConfigController"
+	// ownerAnnotation is the annotation of alert rules naming the configmap entry they were created from,
+	// grafana does not send annotations enclosed in double underscores with notifications
+	ownerAnnotation = "__grafanaConfigController__"
+)
+
+// owner is the configmap entry a grafana object was created from
+type owner struct {
+	Id        int    `json:"id"`
+	Namespace string `json:"namespace"`
+	ConfigMap string `json:"configmap"`
+	Key       string `json:"key"`
+}
+
+// return the owner of the grafana object created from the entry k of a configmap
+func (c *Controller) owner(configmapObj *v1.ConfigMap, k string) owner {
+	return owner{Id: c.config.Id, Namespace: configmapObj.Namespace, ConfigMap: configmapObj.Name, Key: k}
+}
+
+// return the dashboard tag of an owner, e.g. gcc:0:5d41402abc4b2a76, grafana stores at most 50 characters of a tag,
+// so it holds the first 16 hex digits of the sha1 of namespace, configmap and key instead of the full owner
+func (o owner) tag() string {
+	sum := sha1.Sum([]byte(o.Namespace + "/" + o.ConfigMap + "/" + o.Key))
+	return fmt.Sprintf("%s%d:%s", ownerTagPrefix, o.Id, hex.EncodeToString(sum[:])[:16])
+}
+
+// return the marker of an owner in notification policy routes and notification templates,
+// e.g. grafana-config-controller:0:monitoring/templates/slack.tmpl
+func (o owner) marker() string {
+	return fmt.Sprintf("%s%d:%s/%s/%s", ownerMarkerPrefix, o.Id, o.Namespace, o.ConfigMap, o.Key)
+}
+
+// is the owner the given configmap of this controller, any entry of the configmap owns the object
+func (c *Controller) isOwner(o owner, configmapObj *v1.ConfigMap) bool {
+	return o.Id == c.config.Id && o.Namespace == configmapObj.Namespace && o.ConfigMap == configmapObj.Name
+}
+
+// stamp a dashboard with its owner tag, replacing the tag of a previous owner, and with the full owner in the model
+func (o owner) stampDashboard(dh *grafana.Dashboard) {
+	tags := []string{}
+	for _, tag := range dh.Tags() {
+		if !strings.HasPrefix(tag, ownerTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	dh.SetTags(append(tags, o.tag()))
+	dh.Model[ownerField] = o
+}
+
+// stamp a datasource with its owner in jsonData
+func (o owner) stampDatasource(ds *grafana.Datasource) {
+	if ds.JsonData == nil {
+		ds.JsonData = make(map[string]interface{})
+	}
+	ds.JsonData[ownerField] = o
+}
+
+// stamp a notification channel with its owner in settings
+func (o owner) stampNotificationChannel(nc *grafana.NotificationChannel) {
+	if nc.Settings == nil {
+		nc.Settings = make(map[string]interface{})
+	}
+	nc.Settings[ownerField] = o
+}
+
+// stamp a contact point with its owner in settings
+func (o owner) stampContactPoint(contactPoint *grafana.ContactPoint) {
+	if contactPoint.Settings == nil {
+		contactPoint.Settings = make(map[string]interface{})
+	}
+	contactPoint.Settings[ownerField] = o
+}
+
+// stamp a library panel with its owner in the model
+func (o owner) stampLibraryPanel(element *grafana.LibraryElement) {
+	if element.Model == nil {
+		element.Model = make(map[string]interface{})
+	}
+	element.Model[ownerField] = o
+}
+
+// stamp an alert rule with its owner in the annotations
+func (o owner) stampAlertRule(rule *grafana.AlertRule) {
+	annotations := make(map[string]string, len(rule.Annotations)+1)
+	for k, v := range rule.Annotations {
+		annotations[k] = v
+	}
+	b, _ := json.Marshal(o)
+	annotations[ownerAnnotation] = string(b)
+	rule.Annotations = annotations
+}
+
+// parse the owner stamped on a grafana object, given as object or as json string, return false if it has none
+func parseOwner(v interface{}) (owner, bool) {
+	var o owner
+	if v == nil || v == "" {
+		return o, false
+	}
+	b, err := json.Marshal(v)
+	if s, isString := v.(string); isString {
+		b = []byte(s)
+	}
+	if err != nil {
+		return o, false
+	}
+	if err = json.Unmarshal(b, &o); err != nil {
+		return o, false
+	}
+	return o, o.ConfigMap != ""
+}
+
+// return the owner tag of a dashboard, "" if it has none
+func dashboardTag(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, ownerTagPrefix) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// return the entry of a configmap a dashboard tag belongs to, return false if the tag belongs to none
+func (c *Controller) tagOwner(tag string, configmapObj *v1.ConfigMap) (owner, bool) {
+	for k := range configmapObj.Data {
+		if o := c.owner(configmapObj, k); o.tag() == tag {
+			return o, true
+		}
+	}
+	return owner{}, false
+}
+
+// parse the owner of a marker of a notification policy route or notification template, return false if it is none
+func parseOwnerMarker(marker string) (owner, bool) {
+	var o owner
+	if !strings.HasPrefix(marker, ownerMarkerPrefix) {
+		return o, false
+	}
+	var source string
+	if _, err := fmt.Sscanf(strings.TrimPrefix(marker, ownerMarkerPrefix), "%d:%s", &o.Id, &source); err != nil {
+		return o, false
+	}
+	parts := strings.SplitN(source, "/", 3)
+	if len(parts) != 3 {
+		return o, false
+	}
+	o.Namespace, o.ConfigMap, o.Key = parts[0], parts[1], parts[2]
+	return o, true
+}
+
+// may the controller change or delete an object with the given owner on behalf of a configmap,
+// objects without owner are only taken over if AdoptUnowned is set
+func (c *Controller) mayTouch(o owner, stamped bool, configmapObj *v1.ConfigMap) bool {
+	if !stamped {
+		return c.config.AdoptUnowned
+	}
+	return c.isOwner(o, configmapObj)
+}
+
+// may the controller change an object with the given owner on behalf of a configmap, exact is set if the object has
+// the name, uid and folder the configmap entry would create it with, such an object without owner is taken over
+// even if AdoptUnowned is not set
+func (c *Controller) mayAdopt(o owner, stamped bool, exact bool, configmapObj *v1.ConfigMap) bool {
+	return (!stamped && exact) || c.mayTouch(o, stamped, configmapObj)
+}
+
+// return the uid of a dashboard without owner with the uid, title and folder the dashboard of a configmap entry
+// would be created with, "" if there is none
+func adoptableDashboardUid(hits []grafana.SearchHit, dh grafana.Dashboard, o owner) string {
+	uid := dh.Uid()
+	if uid == "" {
+		uid = o.uid()
+	}
+	for _, hit := range hits {
+		if dashboardTag(hit.Tags) == "" && hit.Type == "dash-db" && hit.Uid == uid && hit.Title == dh.Title() && hit.FolderId == dh.FolderId {
+			return hit.Uid
+		}
+	}
+	return ""
+}
+
+// return the id of a datasource without owner with the name, type and uid of a new datasource, -1 if there is none
+func adoptableDatasourceId(datasources []grafana.Datasource, newDatasource grafana.Datasource) int {
+	for _, ds := range datasources {
+		if _, stamped := parseOwner(ds.JsonData[ownerField]); !stamped && (newDatasource.Uid == "" || ds.Uid == newDatasource.Uid) {
+			if id := lookUpDatasourceId([]grafana.Datasource{ds}, newDatasource); id != -1 {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+// return the id of a notification channel without owner with the name, type and uid of a new notification channel,
+// -1 if there is none
+func adoptableNotificationChannelId(notificationChannels []grafana.NotificationChannel, newNotificationChannel grafana.NotificationChannel) int {
+	for _, nc := range notificationChannels {
+		if _, stamped := parseOwner(nc.Settings[ownerField]); !stamped && (newNotificationChannel.Uid == "" || nc.Uid == newNotificationChannel.Uid) {
+			if id := lookUpNotificationChannelId([]grafana.NotificationChannel{nc}, newNotificationChannel); id != -1 {
+				return id
+			}
+		}
+	}
+	return -1
+}
+
+// return the dashboards of a search owned by a configmap, a dashboard is owned if its tag belongs to an entry of the configmap
+func (c *Controller) ownedDashboards(hits []grafana.SearchHit, configmapObj *v1.ConfigMap) []grafana.SearchHit {
+	owned := make([]grafana.SearchHit, 0, len(hits))
+	for _, hit := range hits {
+		tag := dashboardTag(hit.Tags)
+		if o, _ := c.tagOwner(tag, configmapObj); c.mayTouch(o, tag != "", configmapObj) {
+			owned = append(owned, hit)
+		}
+	}
+	return owned
+}
+
+// return the datasources owned by a configmap
+func (c *Controller) ownedDatasources(datasources []grafana.Datasource, configmapObj *v1.ConfigMap) []grafana.Datasource {
+	owned := make([]grafana.Datasource, 0, len(datasources))
+	for _, ds := range datasources {
+		if o, stamped := parseOwner(ds.JsonData[ownerField]); c.mayTouch(o, stamped, configmapObj) {
+			owned = append(owned, ds)
+		}
+	}
+	return owned
+}
+
+// return the notification channels owned by a configmap
+func (c *Controller) ownedNotificationChannels(notificationChannels []grafana.NotificationChannel, configmapObj *v1.ConfigMap) []grafana.NotificationChannel {
+	owned := make([]grafana.NotificationChannel, 0, len(notificationChannels))
+	for _, nc := range notificationChannels {
+		if o, stamped := parseOwner(nc.Settings[ownerField]); c.mayTouch(o, stamped, configmapObj) {
+			owned = append(owned, nc)
+		}
+	}
+	return owned
+}
+
+// return an error if a dashboard with the same uid, or with the same title in the folder, exists which is not owned by the configmap,
+// saving the dashboard with overwrite would replace it
+func (c *Controller) checkDashboardOwner(hits []grafana.SearchHit, dh grafana.Dashboard, configmapObj *v1.ConfigMap) error {
+	owned := make(map[string]bool)
+	for _, hit := range c.ownedDashboards(hits, configmapObj) {
+		owned[hit.Uid] = true
+	}
+	// the uid of the dashboard is set, so the owner to derive one from is not needed
+	if uid := adoptableDashboardUid(hits, dh, owner{}); uid != "" {
+		owned[uid] = true
+	}
+	for _, hit := range hits {
+		if hit.Type != "dash-db" || owned[hit.Uid] {
+			continue
+		}
+		if hit.Uid == dh.Uid() {
+			return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a dashboard with the same uid which is not owned by the configmap exists"}
+		}
+		if hit.Title == dh.Title() && hit.FolderId == dh.FolderId {
+			return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a dashboard with the same name which is not owned by the configmap exists in the folder"}
+		}
+	}
+	return nil
+}
+
+// return the uid of a dashboard created from the owner entry whose json has no uid, derived from namespace, configmap and key
+func (o owner) uid() string {
+	sum := sha1.Sum([]byte(o.Namespace + "/" + o.ConfigMap + "/" + o.Key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// notification policy routes are stamped with the matcher ownerAnnotation != owner marker of the configmap entry the route was created from,
+// no alert has the label ownerAnnotation, so the matcher is true for every alert and does not change which alerts the route matches
+const ownerMatcherType = "!="
+
+// is a notification policy configmap the root of the policy tree instead of a subtree for its namespace
+func isPolicyRoot(configmapObj *v1.ConfigMap) bool {
+	root, _ := configmapObj.Annotations["grafana.net/notification-policy-root"]
+	isRoot, _ := strconv.ParseBool(root)
+	return isRoot
+}
+
+// parse the route of a configmap entry in json or yaml
+func parseRoute(v string) (grafana.Route, error) {
+	var route grafana.Route
+	data, err := yaml.YAMLToJSON([]byte(v))
+	if err != nil {
+		return route, err
+	}
+	err = json.Unmarshal(data, &route)
+	return route, err
+}
+
+// stamp a route with its owner matcher, replacing the matcher of a previous owner
+func (o owner) stampRoute(route *grafana.Route) {
+	matchers := make([][]string, 0, len(route.ObjectMatchers)+1)
+	for _, matcher := range route.ObjectMatchers {
+		if len(matcher) != 3 || matcher[0] != ownerAnnotation {
+			matchers = append(matchers, matcher)
+		}
+	}
+	route.ObjectMatchers = append(matchers, []string{ownerAnnotation, ownerMatcherType, o.marker()})
+}
+
+// parse the owner of a route from its matchers, return false if it has none
+func routeOwner(route grafana.Route) (owner, bool) {
+	for _, matcher := range route.ObjectMatchers {
+		if len(matcher) == 3 && matcher[0] == ownerAnnotation && matcher[1] == ownerMatcherType {
+			return parseOwnerMarker(matcher[2])
+		}
+	}
+	return owner{}, false
+}
+
+// format the durations of a route and its nested routes like grafana does, so unchanged routes show no drift
+func normalizeRoute(route *grafana.Route) {
+	route.GroupWait = formatDuration(route.GroupWait)
+	route.GroupInterval = formatDuration(route.GroupInterval)
+	route.RepeatInterval = formatDuration(route.RepeatInterval)
+	route.Provenance = ""
+	for i := range route.Routes {
+		normalizeRoute(&route.Routes[i])
+	}
+}
+
+// return the routes of a configmap entry to put at the top level of the policy tree, stamped with their owner,
+// and for the root configmap the root route whose settings replace those of the tree
+func (c *Controller) desiredRoutes(configmapObj *v1.ConfigMap, k string, v string) (*grafana.Route, []grafana.Route, error) {
+	route, err := parseRoute(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	normalizeRoute(&route)
+	o := c.owner(configmapObj, k)
+	if isPolicyRoot(configmapObj) {
+		routes := route.Routes
+		route.Routes = nil
+		for i := range routes {
+			o.stampRoute(&routes[i])
+		}
+		return &route, routes, nil
+	}
+	// a subtree only routes the alerts of the namespace of its configmap
+	namespaceMatcher := []string{c.config.NamespaceLabel, "=", configmapObj.Namespace}
+	matchers := [][]string{namespaceMatcher}
+	for _, matcher := range route.ObjectMatchers {
+		if !reflect.DeepEqual(matcher, namespaceMatcher) {
+			matchers = append(matchers, matcher)
+		}
+	}
+	route.ObjectMatchers = matchers
+	o.stampRoute(&route)
+	return nil, []grafana.Route{route}, nil
+}
+
+// return the tree with the routes of owner o replaced by routes and the settings of root, if given,
+// replaced routes keep their position, new subtrees are put in front and new routes of the root configmap at the end
+func applyRoutes(tree grafana.Route, o owner, root *grafana.Route, routes []grafana.Route) grafana.Route {
+	result := tree
+	if root != nil {
+		result = *root
+	}
+	result.Routes = make([]grafana.Route, 0, len(tree.Routes)+len(routes))
+	inserted := false
+	for _, route := range tree.Routes {
+		if ro, stamped := routeOwner(route); stamped && ro == o {
+			if !inserted {
+				result.Routes = append(result.Routes, routes...)
+				inserted = true
+			}
+			continue
+		}
+		result.Routes = append(result.Routes, route)
+	}
+	if !inserted && root == nil {
+		result.Routes = append(append([]grafana.Route{}, routes...), result.Routes...)
+	} else if !inserted {
+		result.Routes = append(result.Routes, routes...)
+	}
+	return result
+}
+
+// are two policy trees the same, apart from their provenance
+func sameTree(a grafana.Route, b grafana.Route) bool {
+	var trees [2]grafana.Route
+	for i, tree := range []grafana.Route{a, b} {
+		data, _ := json.Marshal(tree)
+		json.Unmarshal(data, &trees[i])
+		normalizeRoute(&trees[i])
+	}
+	return reflect.DeepEqual(trees[0], trees[1])
+}
+
+// merge the routes of a configmap entry into the policy tree, the tree is only written if it changes
+func (c *Controller) savePolicy(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	root, routes, err := c.desiredRoutes(configmapObj, k, v)
+	if err != nil {
+		return err
+	}
+	c.policyMtx.Lock()
+	defer c.policyMtx.Unlock()
+	tree, err := c.g.GetPolicyTreeContext(ctx)
+	if err != nil {
+		return err
+	}
+	desired := applyRoutes(*tree, c.owner(configmapObj, k), root, routes)
+	if sameTree(*tree, desired) {
+		return nil
+	}
+	return c.g.UpdatePolicyTreeContext(ctx, desired)
+}
+
+// remove the routes of a configmap entry from the policy tree, the settings of the root route are kept
+func (c *Controller) deletePolicy(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	return c.removeRoutes(ctx, c.owner(configmapObj, k))
+}
+
+// remove the routes of an owner from the policy tree
+func (c *Controller) removeRoutes(ctx context.Context, o owner) error {
+	c.policyMtx.Lock()
+	defer c.policyMtx.Unlock()
+	tree, err := c.g.GetPolicyTreeContext(ctx)
+	if err != nil {
+		return err
+	}
+	desired := applyRoutes(*tree, o, nil, nil)
+	if len(desired.Routes) == len(tree.Routes) {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "notification policy not found"}
+	}
+	return c.g.UpdatePolicyTreeContext(ctx, desired)
+}
+
+// update notification policies per key: merge added and changed keys and remove the routes of removed keys
+func (c *Controller) updatePolicies(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	return c.updateEntries(oldConfigmapObj, configmapObj, c.savePolicy, c.deletePolicy)
+}
+
+// re-apply the routes of entries which are missing in the policy tree or were changed
+func (c *Controller) repairPolicies(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	tree, err := c.g.GetPolicyTreeContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		root, routes, err := c.desiredRoutes(configmapObj, k, v)
+		if err != nil {
+			continue
+		}
+		if sameTree(*tree, applyRoutes(*tree, c.owner(configmapObj, k), root, routes)) {
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Drift detected, notification policy is missing or was changed, updating notification policy: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		err = c.savePolicy(ctx, configmapObj, k, v)
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
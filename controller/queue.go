@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// remember the latest version of a configmap and queue it for sync
+func (c *Controller) enqueue(obj interface{}) {
+	configmapObj, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		level.Error(c.logger).Log("msg", "Skipping object which is no configmap", "type", fmt.Sprintf("%T", obj))
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(configmapObj)
+	if err != nil {
+		level.Error(c.logger).Log("err", err.Error())
+		return
+	}
+	handles := c.handles(configmapObj)
+	c.mtx.Lock()
+	previous := c.desired[key]
+	if handles {
+		c.desired[key] = configmapObj
+	} else {
+		delete(c.desired, key)
+	}
+	_, applied := c.applied[key]
+	c.mtx.Unlock()
+	// a new version which only differs in the status annotations written by the controller needs no sync
+	if handles && previous != nil && previous.ResourceVersion != configmapObj.ResourceVersion && noDifference(previous, configmapObj) {
+		level.Debug(c.logger).Log("msg", "Skipping configmap with changed sync status: "+configmapObj.Name)
+		return
+	}
+	// a configmap which is not handled anymore has to be removed from grafana
+	if handles || applied {
+		c.queue.Add(key)
+	} else {
+		level.Debug(c.logger).Log("msg", "Skipping configmap: "+configmapObj.Name)
+	}
+}
+
+// sync queued configmaps until stopCh is closed, failed configmaps are requeued with exponential backoff,
+// the first garbage collection waits until hasSynced returns true, so the configmaps are known, nil does not wait
+func (c *Controller) Run(stopCh <-chan struct{}, wg *sync.WaitGroup, hasSynced cache.InformerSynced) {
+	defer wg.Done()
+
+	workers := c.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	go func() {
+		if hasSynced != nil && !cache.WaitForCacheSync(stopCh, hasSynced) {
+			return
+		}
+		c.resyncLoop(c.config.ResyncInterval, stopCh)
+	}()
+	var running sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for c.processNextItem() {
+			}
+		}()
+	}
+	<-stopCh
+	c.queue.ShutDown()
+	running.Wait()
+	if c.sink != nil {
+		c.sink.Stop()
+	}
+}
+
+// sync the next queued configmap, return false if the queue was shut down
+func (c *Controller) processNextItem() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	err := c.sync(key)
+	if err == nil {
+		c.queue.Forget(item)
+		return true
+	}
+	select {
+	case <-c.ctx.Done():
+		// shutting down, the configmap is synced again on the next start
+		return true
+	default:
+	}
+	if isPermanent(err) {
+		level.Info(c.logger).Log("msg", "Not requeuing configmap, retrying does not fix: "+key)
+		level.Error(c.logger).Log("err", err.Error())
+		c.queue.Forget(item)
+		return true
+	}
+	if c.config.MaxRequeues > 0 && c.queue.NumRequeues(item) >= c.config.MaxRequeues {
+		level.Info(c.logger).Log("msg", "Dropping configmap after too many retries: "+key)
+		level.Error(c.logger).Log("err", err.Error())
+		c.queue.Forget(item)
+		return true
+	}
+	level.Info(c.logger).Log("msg", "Requeuing configmap: "+key, "retries", c.queue.NumRequeues(item))
+	c.queue.AddRateLimited(item)
+	return true
+}
+
+// bring grafana from the last synced version of a configmap to its latest version
+func (c *Controller) sync(key string) error {
+	c.mtx.Lock()
+	desired := c.desired[key]
+	applied := c.applied[key]
+	repair := c.repairs[key]
+	delete(c.repairs, key)
+	c.mtx.Unlock()
+
+	var err error
+	changed := false
+	switch {
+	case desired == nil && applied == nil:
+		return nil
+	case desired == nil:
+		err = c.delete(applied)
+	case applied == nil:
+		err = c.create(desired)
+		changed = true
+	case repair && noDifference(applied, desired):
+		err = c.repair(desired)
+	default:
+		err = c.update(applied, desired)
+		changed = !noDifference(applied, desired)
+	}
+	// a deleted configmap has no status, one which is not handled anymore may belong to another controller now
+	if desired != nil && !c.statusKept(key, applied, desired, err) {
+		c.writeStatus(desired, err, changed)
+	}
+	if err != nil {
+		if repair {
+			c.mtx.Lock()
+			c.repairs[key] = true
+			c.mtx.Unlock()
+		}
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if desired == nil {
+		delete(c.applied, key)
+		delete(c.statuses, key)
+	} else {
+		c.applied[key] = desired
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// annotations written back to the configmap after its sync
+const (
+	// statusAnnotation is Synced, Failed, Unsupported or Planned
+	statusAnnotation = "grafana.net/sync-status"
+	// lastSyncedAnnotation is the RFC 3339 time the configmap was last synced successfully
+	lastSyncedAnnotation = "grafana.net/last-synced"
+	// lastErrorAnnotation is the error of the last failed sync, it is removed by the next successful sync
+	lastErrorAnnotation = "grafana.net/last-error"
+	// dashboardUidsAnnotation lists the comma separated uids of the dashboards created from the configmap
+	dashboardUidsAnnotation = "grafana.net/dashboard-uids"
+	// dashboardUrlsAnnotation lists the comma separated urls of the dashboards, relative to the grafana url
+	dashboardUrlsAnnotation = "grafana.net/dashboard-urls"
+	// muteTimingsAnnotation lists the comma separated names of the mute timings created from the configmap,
+	// mute timings cannot carry an owner, so only these are updated and deleted
+	muteTimingsAnnotation = "grafana.net/mute-timings"
+)
+
+// values of the sync status annotation
+const (
+	statusSynced = "Synced"
+	statusFailed = "Failed"
+	// statusUnsupported is the status of a configmap whose annotations the grafana version cannot honor
+	statusUnsupported = "Unsupported"
+	// statusPlanned is the status of a configmap whose changes were only planned in a dry run
+	statusPlanned = "Planned"
+)
+
+// is an annotation written by the controller, such annotations are no change of the configmap
+func isStatusAnnotation(k string) bool {
+	switch k {
+	case statusAnnotation, lastSyncedAnnotation, lastErrorAnnotation, dashboardUidsAnnotation, dashboardUrlsAnnotation, muteTimingsAnnotation:
+		return true
+	}
+	return false
+}
+
+// write the outcome of the sync of a configmap to its status annotations, changed is set if grafana objects were created or updated,
+// the annotations are only written if the status differs or something changed
+func (c *Controller) writeStatus(configmapObj *v1.ConfigMap, err error, changed bool) {
+	if c.kclient == nil {
+		return
+	}
+	annotations := map[string]interface{}{}
+	annotations[statusAnnotation] = syncStatus(err)
+	if err != nil {
+		annotations[lastErrorAnnotation] = err.Error()
+	} else if c.config.DryRun {
+		// nothing was created, so there are no dashboards or mute timings to list
+		annotations[statusAnnotation] = statusPlanned
+		annotations[lastErrorAnnotation] = nil
+	} else {
+		annotations[lastErrorAnnotation] = nil
+		if kindOf(configmapObj) == kindDashboard {
+			uids, urls, err := c.appliedDashboards(configmapObj)
+			if err != nil {
+				level.Info(c.logger).Log("msg", "Failed to search dashboards of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+				level.Error(c.logger).Log("err", err.Error())
+			} else {
+				annotations[dashboardUidsAnnotation] = uids
+				annotations[dashboardUrlsAnnotation] = urls
+			}
+		}
+	}
+	// mute timings created before a failure are recorded too, so the retry may update them
+	if kindOf(configmapObj) == kindMuteTiming && !c.config.DryRun {
+		if names := c.createdMuteTimingNames(configmapObj); names != "" {
+			annotations[muteTimingsAnnotation] = names
+		} else {
+			annotations[muteTimingsAnnotation] = nil
+		}
+	}
+	status := annotations[statusAnnotation].(string)
+	if !changed && !statusChanged(configmapObj, annotations) {
+		c.recordStatus(configmapObj, status)
+		return
+	}
+	if err == nil && !c.config.DryRun {
+		annotations[lastSyncedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		level.Error(c.logger).Log("err", err.Error())
+		return
+	}
+	_, err = c.kclient.CoreV1().ConfigMaps(configmapObj.Namespace).Patch(configmapObj.Name, types.MergePatchType, patch)
+	if err != nil && !errors.IsNotFound(err) {
+		level.Info(c.logger).Log("msg", "Failed to write sync status of configmap: "+configmapObj.Name, "namespace", configmapObj.Namespace)
+		level.Error(c.logger).Log("err", err.Error())
+		status = ""
+	}
+	c.recordStatus(configmapObj, status)
+}
+
+// is a successful sync of an unchanged configmap, e.g. on an informer resync, one whose status was already written,
+// then neither grafana is searched for its dashboards nor the configmap is patched
+func (c *Controller) statusKept(key string, applied *v1.ConfigMap, desired *v1.ConfigMap, err error) bool {
+	if err != nil || applied == nil || !noDifference(applied, desired) {
+		return false
+	}
+	status := statusSynced
+	if c.config.DryRun {
+		status = statusPlanned
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.statuses[key] == status
+}
+
+// remember the status last written to a configmap, "" if writing it failed
+func (c *Controller) recordStatus(configmapObj *v1.ConfigMap, status string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.statuses[configmapObj.Namespace+"/"+configmapObj.Name] = status
+}
+
+// do the status annotations differ from the ones of the configmap, a nil value is a removed annotation
+func statusChanged(configmapObj *v1.ConfigMap, annotations map[string]interface{}) bool {
+	for k, v := range annotations {
+		current, ok := configmapObj.Annotations[k]
+		if s, isString := v.(string); (isString && s != current) || (!isString && ok) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the comma separated uids and urls of the dashboards owned by a configmap
+func (c *Controller) appliedDashboards(configmapObj *v1.ConfigMap) (string, string, error) {
+	ctx, err := c.orgContext(configmapObj, false)
+	if err != nil {
+		return "", "", err
+	}
+	hits, err := c.g.SearchDashboardContext(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Uid < hits[j].Uid })
+	var uids, urls []string
+	for _, hit := range hits {
+		if _, owned := c.tagOwner(dashboardTag(hit.Tags), configmapObj); hit.Type == "dash-db" && owned {
+			uids = append(uids, hit.Uid)
+			urls = append(urls, hit.Url)
+		}
+	}
+	return strings.Join(uids, ","), strings.Join(urls, ","), nil
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/api/core/v1"
+)
+
+// notification templates are stamped with a go template comment holding the owner marker in their first line
+const (
+	templateOwnerPrefix = "{{/* "
+	templateOwnerSuffix = " */}}"
+)
+
+// return the notification template of a configmap entry stamped with its owner, it is named by the key without .tmpl
+func (c *Controller) buildTemplate(configmapObj *v1.ConfigMap, k string, v string) grafana.NotificationTemplate {
+	template := grafana.NotificationTemplate{Name: strings.TrimSuffix(k, ".tmpl"), Template: v}
+	c.owner(configmapObj, k).stampTemplate(&template)
+	return template
+}
+
+// stamp a notification template with its owner in a comment, replacing the comment of a previous owner
+func (o owner) stampTemplate(template *grafana.NotificationTemplate) {
+	if _, stamped := templateOwner(*template); stamped {
+		template.Template = template.Template[strings.Index(template.Template, "\n")+1:]
+	}
+	template.Template = templateOwnerPrefix + o.marker() + templateOwnerSuffix + "\n" + template.Template
+}
+
+// parse the owner of a notification template from its first line, return false if it has none
+func templateOwner(template grafana.NotificationTemplate) (owner, bool) {
+	line := strings.SplitN(template.Template, "\n", 2)[0]
+	if !strings.HasPrefix(line, templateOwnerPrefix) || !strings.HasSuffix(line, templateOwnerSuffix) {
+		return owner{}, false
+	}
+	return parseOwnerMarker(strings.TrimSuffix(strings.TrimPrefix(line, templateOwnerPrefix), templateOwnerSuffix))
+}
+
+// create or replace the notification template of a configmap entry
+func (c *Controller) saveTemplate(ctx context.Context, configmapObj *v1.ConfigMap, k string, v string) error {
+	template := c.buildTemplate(configmapObj, k, v)
+	live, err := c.g.SearchNotificationTemplatesContext(ctx)
+	if err != nil {
+		return err
+	}
+	if existing := findTemplate(live, template.Name); existing != nil {
+		// a template without owner is identified by its name only, it is taken over if it has the content of the entry
+		if o, stamped := templateOwner(*existing); !c.mayAdopt(o, stamped, existing.Template == v, configmapObj) {
+			return &grafana.APIError{StatusCode: http.StatusPreconditionFailed, Message: "a notification template with the same name which is not owned by the configmap exists"}
+		}
+	}
+	return c.g.UpdateNotificationTemplateContext(ctx, template)
+}
+
+// delete the notification template of a configmap entry
+func (c *Controller) deleteTemplate(ctx context.Context, configmapObj *v1.ConfigMap, k string) error {
+	template := c.buildTemplate(configmapObj, k, configmapObj.Data[k])
+	live, err := c.g.SearchNotificationTemplatesContext(ctx)
+	if err != nil {
+		return err
+	}
+	existing := findTemplate(live, template.Name)
+	if existing == nil {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "notification template not found"}
+	}
+	if o, stamped := templateOwner(*existing); !c.mayTouch(o, stamped, configmapObj) {
+		return &grafana.APIError{StatusCode: http.StatusNotFound, Message: "notification template not found"}
+	}
+	return c.g.DeleteNotificationTemplateContext(ctx, template.Name)
+}
+
+// update notification templates per key: save added and changed keys and delete the templates of removed keys
+func (c *Controller) updateTemplates(oldConfigmapObj *v1.ConfigMap, configmapObj *v1.ConfigMap) error {
+	return c.updateEntries(oldConfigmapObj, configmapObj, c.saveTemplate, c.deleteTemplate)
+}
+
+// re-apply missing or changed notification templates
+func (c *Controller) repairTemplates(configmapObj *v1.ConfigMap) error {
+	ctx, err := c.orgContext(configmapObj, c.config.CreateOrgs)
+	if err != nil {
+		return err
+	}
+	live, err := c.g.SearchNotificationTemplatesContext(ctx)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for k, v := range configmapObj.Data {
+		template := c.buildTemplate(configmapObj, k, v)
+		existing := findTemplate(live, template.Name)
+		if existing == nil {
+			level.Info(c.logger).Log("msg", "Drift detected, notification template is missing, creating notification template: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		} else if existing.Template != template.Template {
+			if o, stamped := templateOwner(*existing); !c.mayTouch(o, stamped, configmapObj) {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "Drift detected, notification template was changed, updating notification template: "+k, "configmap", configmapObj.Name, "namespace", configmapObj.Namespace)
+		} else {
+			continue
+		}
+		err = c.g.UpdateNotificationTemplateContext(ctx, template)
+		failed = c.logRepair(err, k, configmapObj, failed)
+	}
+	return failed
+}
+
+// search notification template by name
+func findTemplate(templates []grafana.NotificationTemplate, name string) *grafana.NotificationTemplate {
+	for _, template := range templates {
+		if template.Name == name {
+			return &template
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package grafana
+
+import (
+	"context"
+)
+
+// AlertRule is a unified alerting rule as returned and accepted by the provisioning api
+type AlertRule struct {
+	Id                   int                      `json:"id,omitempty"`
+	Uid                  string                   `json:"uid,omitempty"`
+	OrgId                int                      `json:"orgID,omitempty"`
+	FolderUid            string                   `json:"folderUID"`
+	RuleGroup            string                   `json:"ruleGroup"`
+	Title                string                   `json:"title"`
+	Condition            string                   `json:"condition"`
+	Data                 []map[string]interface{} `json:"data"`
+	Updated              string                   `json:"updated,omitempty"`
+	NoDataState          string                   `json:"noDataState,omitempty"`
+	ExecErrState         string                   `json:"execErrState,omitempty"`
+	For                  string                   `json:"for,omitempty"`
+	Annotations          map[string]string        `json:"annotations,omitempty"`
+	Labels               map[string]string        `json:"labels,omitempty"`
+	IsPaused             bool                     `json:"isPaused"`
+	NotificationSettings map[string]interface{}   `json:"notification_settings,omitempty"`
+	Provenance           string                   `json:"provenance,omitempty"`
+}
+
+// AlertRuleGroup is a group of alert rules in a folder which are evaluated together every interval
+type AlertRuleGroup struct {
+	Title     string `json:"title"`
+	FolderUid string `json:"folderUid"`
+	// Interval is the evaluation interval in seconds
+	Interval int64       `json:"interval"`
+	Rules    []AlertRule `json:"rules"`
+}
+
+// return all alert rules of the organization
+func (c *APIClient) SearchAlertRules() ([]AlertRule, error) {
+	return c.SearchAlertRulesContext(context.Background())
+}
+
+func (c *APIClient) SearchAlertRulesContext(ctx context.Context) ([]AlertRule, error) {
+	var rules []AlertRule
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/alert-rules"), &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// return the alert rule group with the given title in a folder
+func (c *APIClient) GetAlertRuleGroup(folderUid string, title string) (*AlertRuleGroup, error) {
+	return c.GetAlertRuleGroupContext(context.Background(), folderUid, title)
+}
+
+func (c *APIClient) GetAlertRuleGroupContext(ctx context.Context, folderUid string, title string) (*AlertRuleGroup, error) {
+	group := &AlertRuleGroup{}
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/folder/"+folderUid+"/rule-groups/"+title), group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// create or replace an alert rule group, rules of the group missing in it are deleted
+func (c *APIClient) UpdateAlertRuleGroup(group AlertRuleGroup) (*AlertRuleGroup, error) {
+	return c.UpdateAlertRuleGroupContext(context.Background(), group)
+}
+
+func (c *APIClient) UpdateAlertRuleGroupContext(ctx context.Context, group AlertRuleGroup) (*AlertRuleGroup, error) {
+	result := &AlertRuleGroup{}
+	err := c.doPut(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/folder/"+group.FolderUid+"/rule-groups/"+group.Title), group, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *APIClient) DeleteAlertRule(uid string) error {
+	return c.DeleteAlertRuleContext(context.Background(), uid)
+}
+
+func (c *APIClient) DeleteAlertRuleContext(ctx context.Context, uid string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/alert-rules/"+uid))
+}
+
+// ContactPoint is a unified alerting contact point as returned and accepted by the provisioning api,
+// secure settings are returned as [REDACTED]
+type ContactPoint struct {
+	Uid                   string                 `json:"uid,omitempty"`
+	Name                  string                 `json:"name"`
+	Type                  string                 `json:"type"`
+	Settings              map[string]interface{} `json:"settings"`
+	DisableResolveMessage bool                   `json:"disableResolveMessage"`
+	Provenance            string                 `json:"provenance,omitempty"`
+}
+
+// return all contact points of the organization
+func (c *APIClient) SearchContactPoints() ([]ContactPoint, error) {
+	return c.SearchContactPointsContext(context.Background())
+}
+
+func (c *APIClient) SearchContactPointsContext(ctx context.Context) ([]ContactPoint, error) {
+	contactPoints := make([]ContactPoint, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/contact-points"), &contactPoints)
+	if err != nil {
+		return nil, err
+	}
+	return contactPoints, nil
+}
+
+func (c *APIClient) CreateContactPoint(contactPoint ContactPoint) error {
+	return c.CreateContactPointContext(context.Background(), contactPoint)
+}
+
+func (c *APIClient) CreateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/contact-points"), contactPoint, nil)
+}
+
+func (c *APIClient) UpdateContactPoint(contactPoint ContactPoint) error {
+	return c.UpdateContactPointContext(context.Background(), contactPoint)
+}
+
+func (c *APIClient) UpdateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	return c.doPut(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/contact-points/"+contactPoint.Uid), contactPoint, nil)
+}
+
+func (c *APIClient) DeleteContactPoint(uid string) error {
+	return c.DeleteContactPointContext(context.Background(), uid)
+}
+
+func (c *APIClient) DeleteContactPointContext(ctx context.Context, uid string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/contact-points/"+uid))
+}
+
+// Route is a notification policy, the root of the policy tree or one of its nested routes
+type Route struct {
+	Receiver            string            `json:"receiver,omitempty"`
+	GroupBy             []string          `json:"group_by,omitempty"`
+	ObjectMatchers      [][]string        `json:"object_matchers,omitempty"`
+	Matchers            []string          `json:"matchers,omitempty"`
+	Match               map[string]string `json:"match,omitempty"`
+	MatchRe             map[string]string `json:"match_re,omitempty"`
+	MuteTimeIntervals   []string          `json:"mute_time_intervals,omitempty"`
+	ActiveTimeIntervals []string          `json:"active_time_intervals,omitempty"`
+	Continue            bool              `json:"continue,omitempty"`
+	GroupWait           string            `json:"group_wait,omitempty"`
+	GroupInterval       string            `json:"group_interval,omitempty"`
+	RepeatInterval      string            `json:"repeat_interval,omitempty"`
+	Routes              []Route           `json:"routes,omitempty"`
+	Provenance          string            `json:"provenance,omitempty"`
+}
+
+// return the notification policy tree of the organization
+func (c *APIClient) GetPolicyTree() (*Route, error) {
+	return c.GetPolicyTreeContext(context.Background())
+}
+
+func (c *APIClient) GetPolicyTreeContext(ctx context.Context) (*Route, error) {
+	tree := &Route{}
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/policies"), tree)
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// replace the notification policy tree of the organization
+func (c *APIClient) UpdatePolicyTree(tree Route) error {
+	return c.UpdatePolicyTreeContext(context.Background(), tree)
+}
+
+func (c *APIClient) UpdatePolicyTreeContext(ctx context.Context, tree Route) error {
+	return c.doPut(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/policies"), tree, nil)
+}
+
+// MuteTiming is a named set of time intervals in which notifications of the policies referring to it are muted
+type MuteTiming struct {
+	Name          string                   `json:"name"`
+	TimeIntervals []map[string]interface{} `json:"time_intervals"`
+	Version       string                   `json:"version,omitempty"`
+	Provenance    string                   `json:"provenance,omitempty"`
+}
+
+// NotificationTemplate is a named group of go templates used in the messages of contact points
+type NotificationTemplate struct {
+	Name       string `json:"name"`
+	Template   string `json:"template"`
+	Version    string `json:"version,omitempty"`
+	Provenance string `json:"provenance,omitempty"`
+}
+
+// return all mute timings of the organization
+func (c *APIClient) SearchMuteTimings() ([]MuteTiming, error) {
+	return c.SearchMuteTimingsContext(context.Background())
+}
+
+func (c *APIClient) SearchMuteTimingsContext(ctx context.Context) ([]MuteTiming, error) {
+	muteTimings := make([]MuteTiming, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/mute-timings"), &muteTimings)
+	if err != nil {
+		return nil, err
+	}
+	return muteTimings, nil
+}
+
+func (c *APIClient) CreateMuteTiming(muteTiming MuteTiming) error {
+	return c.CreateMuteTimingContext(context.Background(), muteTiming)
+}
+
+func (c *APIClient) CreateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/mute-timings"), muteTiming, nil)
+}
+
+func (c *APIClient) UpdateMuteTiming(muteTiming MuteTiming) error {
+	return c.UpdateMuteTimingContext(context.Background(), muteTiming)
+}
+
+func (c *APIClient) UpdateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	return c.doPut(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/mute-timings/"+muteTiming.Name), muteTiming, nil)
+}
+
+func (c *APIClient) DeleteMuteTiming(name string) error {
+	return c.DeleteMuteTimingContext(context.Background(), name)
+}
+
+func (c *APIClient) DeleteMuteTimingContext(ctx context.Context, name string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/mute-timings/"+name))
+}
+
+// return all notification templates of the organization
+func (c *APIClient) SearchNotificationTemplates() ([]NotificationTemplate, error) {
+	return c.SearchNotificationTemplatesContext(context.Background())
+}
+
+func (c *APIClient) SearchNotificationTemplatesContext(ctx context.Context) ([]NotificationTemplate, error) {
+	templates := make([]NotificationTemplate, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/templates"), &templates)
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// create or replace a notification template
+func (c *APIClient) UpdateNotificationTemplate(template NotificationTemplate) error {
+	return c.UpdateNotificationTemplateContext(context.Background(), template)
+}
+
+func (c *APIClient) UpdateNotificationTemplateContext(ctx context.Context, template NotificationTemplate) error {
+	return c.doPut(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/templates/"+template.Name), template, nil)
+}
+
+func (c *APIClient) DeleteNotificationTemplate(name string) error {
+	return c.DeleteNotificationTemplateContext(context.Background(), name)
+}
+
+func (c *APIClient) DeleteNotificationTemplateContext(ctx context.Context, name string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/v1/provisioning/templates/"+name))
+}
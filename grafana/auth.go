@@ -0,0 +1,89 @@
+package grafana
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds the credentials to every request sent to grafana
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// BasicAuth authenticates with user and password
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.User, a.Password)
+	return nil
+}
+
+// TokenAuth authenticates with a service account token or an api key, grafana accepts both as bearer token
+type TokenAuth struct {
+	Token string
+}
+
+func (a *TokenAuth) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// TokenFileAuth authenticates with a bearer token read from a file,
+// the file is read again whenever it changes so the token can be rotated without restart
+type TokenFileAuth struct {
+	File string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+// return a new TokenFileAuth reading the token from file
+func NewTokenFileAuth(file string) (*TokenFileAuth, error) {
+	a := &TokenFileAuth{File: file}
+	if _, err := a.currentToken(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *TokenFileAuth) Authenticate(req *http.Request) error {
+	token, err := a.currentToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// return the token and read the file again if it changed, the previous token is kept on errors
+func (a *TokenFileAuth) currentToken() (string, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	fileModTime, err := modTime(a.File)
+	if err == nil && !fileModTime.Equal(a.modTime) {
+		var content []byte
+		content, err = ioutil.ReadFile(a.File)
+		if err == nil {
+			token := strings.TrimSpace(string(content))
+			if token == "" {
+				err = errors.New("token file is empty: " + a.File)
+			} else {
+				a.token = token
+				a.modTime = fileModTime
+			}
+		}
+	}
+	if a.token == "" {
+		return "", err
+	}
+	return a.token, nil
+}
@@ -0,0 +1,109 @@
+package grafana
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Capabilities describes the version and the enabled features of a grafana
+type Capabilities struct {
+	Version string
+	Major   int
+	Minor   int
+	// LegacyAlerting is set if /api/alert-notifications is available
+	LegacyAlerting bool
+	// UnifiedAlerting is set if unified alerting is enabled, grafana 8 reports it without having a provisioning api
+	UnifiedAlerting bool
+	// ProvisioningAPI is set if the /api/v1/provisioning alerting endpoints are available
+	ProvisioningAPI bool
+	// NestedFolders is set if folders can contain folders
+	NestedFolders bool
+	// FolderUids is set if dashboards can be saved with the uid of their folder
+	FolderUids bool
+	// LibraryPanels is set if /api/library-elements is available
+	LibraryPanels bool
+}
+
+// is the grafana version at least major.minor
+func (c *Capabilities) AtLeast(major int, minor int) bool {
+	return c.Major > major || (c.Major == major && c.Minor >= minor)
+}
+
+var versionRegexp = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// query the version and the features of grafana and keep them for Capabilities
+func (c *APIClient) DetectCapabilities() (*Capabilities, error) {
+	return c.DetectCapabilitiesContext(context.Background())
+}
+
+func (c *APIClient) DetectCapabilitiesContext(ctx context.Context) (*Capabilities, error) {
+	var health struct {
+		Version string `json:"version"`
+	}
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/health"), &health)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings struct {
+		AlertingEnabled        *bool           `json:"alertingEnabled"`
+		UnifiedAlertingEnabled *bool           `json:"unifiedAlertingEnabled"`
+		FeatureToggles         map[string]bool `json:"featureToggles"`
+		BuildInfo              struct {
+			Version string `json:"version"`
+		} `json:"buildInfo"`
+	}
+	err = c.doGet(ctx, makeUrl(c.BaseUrl, "/api/frontend/settings"), &settings)
+	if err != nil {
+		// the settings need authentication, the version from the health check is enough to go on
+		level.Warn(c.logger).Log("msg", "Failed to read Grafana frontend settings, features are derived from the version only", "err", err.Error())
+	}
+
+	version := health.Version
+	if version == "" {
+		version = settings.BuildInfo.Version
+	}
+	capabilities := NewCapabilities(version)
+	if settings.UnifiedAlertingEnabled != nil {
+		capabilities.UnifiedAlerting = *settings.UnifiedAlertingEnabled || capabilities.Major >= 11
+		capabilities.LegacyAlerting = !capabilities.UnifiedAlerting
+	}
+	if settings.AlertingEnabled != nil && !*settings.AlertingEnabled {
+		capabilities.LegacyAlerting = false
+	}
+	if settings.FeatureToggles["nestedFolders"] {
+		capabilities.NestedFolders = true
+	}
+
+	c.mtx.Lock()
+	c.capabilities = capabilities
+	c.mtx.Unlock()
+	return capabilities, nil
+}
+
+// return the capabilities found by DetectCapabilities or nil if they were not detected yet
+func (c *APIClient) Capabilities() *Capabilities {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.capabilities
+}
+
+// return the capabilities a grafana of the given version has by default
+func NewCapabilities(version string) *Capabilities {
+	capabilities := &Capabilities{Version: version}
+	if m := versionRegexp.FindStringSubmatch(version); m != nil {
+		capabilities.Major, _ = strconv.Atoi(m[1])
+		capabilities.Minor, _ = strconv.Atoi(m[2])
+	}
+	// unified alerting is the default since 9.0 and legacy alerting is removed in 11.0
+	capabilities.UnifiedAlerting = capabilities.AtLeast(9, 0)
+	capabilities.LegacyAlerting = !capabilities.AtLeast(9, 0)
+	capabilities.ProvisioningAPI = capabilities.AtLeast(9, 0)
+	capabilities.NestedFolders = capabilities.AtLeast(11, 0)
+	capabilities.FolderUids = capabilities.AtLeast(8, 0)
+	capabilities.LibraryPanels = capabilities.AtLeast(8, 0)
+	return capabilities
+}
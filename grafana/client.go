@@ -0,0 +1,64 @@
+package grafana
+
+import "context"
+
+// Client is the set of grafana operations the controller depends on,
+// it is implemented by APIClient and by MemoryClient for tests
+type Client interface {
+	SearchDashboardContext(ctx context.Context) ([]SearchHit, error)
+	GetDashboardContext(ctx context.Context, uid string) (*Dashboard, error)
+	CreateDashboardContext(ctx context.Context, dashboard Dashboard) (*DashboardSaveResult, error)
+	DeleteDashboardContext(ctx context.Context, uid string) error
+
+	SearchDatasourceContext(ctx context.Context) ([]Datasource, error)
+	CreateDatasourceContext(ctx context.Context, datasource Datasource) error
+	UpdateDatasourceContext(ctx context.Context, datasource Datasource) error
+	DeleteDatasourceContext(ctx context.Context, name string) error
+
+	SearchNotificationChannelContext(ctx context.Context) ([]NotificationChannel, error)
+	CreateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error
+	UpdateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error
+	DeleteNotificationChannelContext(ctx context.Context, id int) error
+
+	SearchFolderContext(ctx context.Context) ([]Folder, error)
+	CreateFolderContext(ctx context.Context, folder Folder) (*Folder, error)
+
+	CreateUserContext(ctx context.Context, user User) error
+
+	SearchAlertRulesContext(ctx context.Context) ([]AlertRule, error)
+	GetAlertRuleGroupContext(ctx context.Context, folderUid string, title string) (*AlertRuleGroup, error)
+	UpdateAlertRuleGroupContext(ctx context.Context, group AlertRuleGroup) (*AlertRuleGroup, error)
+	DeleteAlertRuleContext(ctx context.Context, uid string) error
+
+	SearchContactPointsContext(ctx context.Context) ([]ContactPoint, error)
+	CreateContactPointContext(ctx context.Context, contactPoint ContactPoint) error
+	UpdateContactPointContext(ctx context.Context, contactPoint ContactPoint) error
+	DeleteContactPointContext(ctx context.Context, uid string) error
+
+	GetPolicyTreeContext(ctx context.Context) (*Route, error)
+	UpdatePolicyTreeContext(ctx context.Context, tree Route) error
+
+	SearchMuteTimingsContext(ctx context.Context) ([]MuteTiming, error)
+	CreateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error
+	UpdateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error
+	DeleteMuteTimingContext(ctx context.Context, name string) error
+
+	SearchNotificationTemplatesContext(ctx context.Context) ([]NotificationTemplate, error)
+	UpdateNotificationTemplateContext(ctx context.Context, template NotificationTemplate) error
+	DeleteNotificationTemplateContext(ctx context.Context, name string) error
+
+	SearchLibraryPanelsContext(ctx context.Context) ([]LibraryElement, error)
+	CreateLibraryElementContext(ctx context.Context, element LibraryElement) error
+	UpdateLibraryElementContext(ctx context.Context, element LibraryElement) error
+	DeleteLibraryElementContext(ctx context.Context, uid string) error
+
+	SearchOrgsContext(ctx context.Context) ([]Org, error)
+	GetOrgByNameContext(ctx context.Context, name string) (*Org, error)
+	CreateOrgContext(ctx context.Context, org Org) (*Org, error)
+
+	DetectCapabilitiesContext(ctx context.Context) (*Capabilities, error)
+	Capabilities() *Capabilities
+}
+
+var _ Client = &APIClient{}
+var _ Client = &MemoryClient{}
@@ -0,0 +1,671 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DryRunClient passes reads to the wrapped client and replaces every mutating call by a planner,
+// which logs the http method, the endpoint and the diff of the payload against the current state without changing grafana,
+// planned folders and organizations get placeholder ids below 0 and uids starting with planned-
+type DryRunClient struct {
+	Client
+	logger log.Logger
+
+	mtx sync.Mutex
+	// placeholders is the number of placeholder ids handed out
+	placeholders int
+}
+
+var _ Client = &DryRunClient{}
+
+// return a client planning the changes of client instead of applying them
+func NewDryRunClient(client Client, logger log.Logger) *DryRunClient {
+	return &DryRunClient{Client: client, logger: logger}
+}
+
+// prefix of the uids of planned objects
+const plannedUidPrefix = "planned-"
+
+// is ctx scoped to an organization which is only planned, grafana has no objects in it
+func plannedOrg(ctx context.Context) bool {
+	orgId, ok := OrgIdFromContext(ctx)
+	return ok && orgId < 0
+}
+
+// return a new placeholder id and uid of a planned object
+func (c *DryRunClient) placeholder() (int, string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.placeholders++
+	return -c.placeholders, plannedUidPrefix + strconv.Itoa(c.placeholders)
+}
+
+// search dashboards, a planned organization has none
+func (c *DryRunClient) SearchDashboardContext(ctx context.Context) ([]SearchHit, error) {
+	if plannedOrg(ctx) {
+		return []SearchHit{}, nil
+	}
+	return c.Client.SearchDashboardContext(ctx)
+}
+
+// get a dashboard, a planned organization has none
+func (c *DryRunClient) GetDashboardContext(ctx context.Context, uid string) (*Dashboard, error) {
+	if plannedOrg(ctx) {
+		return nil, notFound("GET", "/api/dashboards/uid/"+uid, "Dashboard not found")
+	}
+	return c.Client.GetDashboardContext(ctx, uid)
+}
+
+// search datasources, a planned organization has none
+func (c *DryRunClient) SearchDatasourceContext(ctx context.Context) ([]Datasource, error) {
+	if plannedOrg(ctx) {
+		return []Datasource{}, nil
+	}
+	return c.Client.SearchDatasourceContext(ctx)
+}
+
+// search notification channels, a planned organization has none
+func (c *DryRunClient) SearchNotificationChannelContext(ctx context.Context) ([]NotificationChannel, error) {
+	if plannedOrg(ctx) {
+		return []NotificationChannel{}, nil
+	}
+	return c.Client.SearchNotificationChannelContext(ctx)
+}
+
+// search folders, a planned organization has none
+func (c *DryRunClient) SearchFolderContext(ctx context.Context) ([]Folder, error) {
+	if plannedOrg(ctx) {
+		return []Folder{}, nil
+	}
+	return c.Client.SearchFolderContext(ctx)
+}
+
+// search alert rules, a planned organization has none
+func (c *DryRunClient) SearchAlertRulesContext(ctx context.Context) ([]AlertRule, error) {
+	if plannedOrg(ctx) {
+		return []AlertRule{}, nil
+	}
+	return c.Client.SearchAlertRulesContext(ctx)
+}
+
+// get an alert rule group, a planned organization or folder has none
+func (c *DryRunClient) GetAlertRuleGroupContext(ctx context.Context, folderUid string, title string) (*AlertRuleGroup, error) {
+	if plannedOrg(ctx) || strings.HasPrefix(folderUid, plannedUidPrefix) {
+		return nil, notFound("GET", "/api/v1/provisioning/folder/"+folderUid+"/rule-groups/"+title, "rule group not found")
+	}
+	return c.Client.GetAlertRuleGroupContext(ctx, folderUid, title)
+}
+
+// search contact points, a planned organization has none
+func (c *DryRunClient) SearchContactPointsContext(ctx context.Context) ([]ContactPoint, error) {
+	if plannedOrg(ctx) {
+		return []ContactPoint{}, nil
+	}
+	return c.Client.SearchContactPointsContext(ctx)
+}
+
+// get the notification policy tree, a planned organization has the default tree of grafana
+func (c *DryRunClient) GetPolicyTreeContext(ctx context.Context) (*Route, error) {
+	if plannedOrg(ctx) {
+		tree := defaultPolicyTree()
+		return &tree, nil
+	}
+	return c.Client.GetPolicyTreeContext(ctx)
+}
+
+// search mute timings, a planned organization has none
+func (c *DryRunClient) SearchMuteTimingsContext(ctx context.Context) ([]MuteTiming, error) {
+	if plannedOrg(ctx) {
+		return []MuteTiming{}, nil
+	}
+	return c.Client.SearchMuteTimingsContext(ctx)
+}
+
+// search notification templates, a planned organization has none
+func (c *DryRunClient) SearchNotificationTemplatesContext(ctx context.Context) ([]NotificationTemplate, error) {
+	if plannedOrg(ctx) {
+		return []NotificationTemplate{}, nil
+	}
+	return c.Client.SearchNotificationTemplatesContext(ctx)
+}
+
+// search library panels, a planned organization has none
+func (c *DryRunClient) SearchLibraryPanelsContext(ctx context.Context) ([]LibraryElement, error) {
+	if plannedOrg(ctx) {
+		return []LibraryElement{}, nil
+	}
+	return c.Client.SearchLibraryPanelsContext(ctx)
+}
+
+// plan saving a dashboard, the diff is against the dashboard with the same uid
+func (c *DryRunClient) CreateDashboardContext(ctx context.Context, dashboard Dashboard) (*DashboardSaveResult, error) {
+	var current interface{}
+	if uid := dashboard.Uid(); uid != "" {
+		live, err := c.GetDashboardContext(ctx, uid)
+		if err != nil && !IsNotFound(err) {
+			return nil, err
+		}
+		if live != nil {
+			current = dashboardPayload(*live)
+		}
+	}
+	c.plan(ctx, "POST", "/api/dashboards/db", current, dashboardPayload(dashboard))
+	return &DashboardSaveResult{Uid: dashboard.Uid(), Status: "success", Version: dashboard.Version()}, nil
+}
+
+// plan deleting a dashboard
+func (c *DryRunClient) DeleteDashboardContext(ctx context.Context, uid string) error {
+	live, err := c.GetDashboardContext(ctx, uid)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "DELETE", "/api/dashboards/uid/"+uid, dashboardPayload(*live), nil)
+	return nil
+}
+
+// plan creating a datasource, the diff is against the datasource with the same name
+func (c *DryRunClient) CreateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	current, err := c.datasource(ctx, func(ds Datasource) bool { return ds.Name == datasource.Name })
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "POST", "/api/datasources", current, datasource)
+	return nil
+}
+
+// plan updating a datasource
+func (c *DryRunClient) UpdateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	current, err := c.datasource(ctx, func(ds Datasource) bool { return ds.Id == datasource.Id })
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/datasources/"+strconv.Itoa(datasource.Id), current, datasource)
+	return nil
+}
+
+// plan deleting a datasource
+func (c *DryRunClient) DeleteDatasourceContext(ctx context.Context, name string) error {
+	current, err := c.datasource(ctx, func(ds Datasource) bool { return ds.Name == name })
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/datasources/name/"+name, "Data source not found")
+	}
+	c.plan(ctx, "DELETE", "/api/datasources/name/"+name, current, nil)
+	return nil
+}
+
+// plan creating a notification channel, the diff is against the notification channel with the same name
+func (c *DryRunClient) CreateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	current, err := c.notificationChannel(ctx, func(nc NotificationChannel) bool { return nc.Name == notificationChannel.Name })
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "POST", "/api/alert-notifications", current, notificationChannel)
+	return nil
+}
+
+// plan updating a notification channel
+func (c *DryRunClient) UpdateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	current, err := c.notificationChannel(ctx, func(nc NotificationChannel) bool { return nc.Id == notificationChannel.Id })
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/alert-notifications/"+strconv.Itoa(notificationChannel.Id), current, notificationChannel)
+	return nil
+}
+
+// plan deleting a notification channel
+func (c *DryRunClient) DeleteNotificationChannelContext(ctx context.Context, id int) error {
+	current, err := c.notificationChannel(ctx, func(nc NotificationChannel) bool { return nc.Id == id })
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/alert-notifications/"+strconv.Itoa(id), "Notification not found")
+	}
+	c.plan(ctx, "DELETE", "/api/alert-notifications/"+strconv.Itoa(id), current, nil)
+	return nil
+}
+
+// plan replacing an alert rule group
+func (c *DryRunClient) UpdateAlertRuleGroupContext(ctx context.Context, group AlertRuleGroup) (*AlertRuleGroup, error) {
+	var current interface{}
+	live, err := c.GetAlertRuleGroupContext(ctx, group.FolderUid, group.Title)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	if live != nil {
+		current = live
+	}
+	c.plan(ctx, "PUT", "/api/v1/provisioning/folder/"+group.FolderUid+"/rule-groups/"+group.Title, current, group)
+	return &group, nil
+}
+
+// plan deleting an alert rule
+func (c *DryRunClient) DeleteAlertRuleContext(ctx context.Context, uid string) error {
+	rules, err := c.SearchAlertRulesContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Uid == uid {
+			c.plan(ctx, "DELETE", "/api/v1/provisioning/alert-rules/"+uid, rule, nil)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/v1/provisioning/alert-rules/"+uid, "rule not found")
+}
+
+// plan creating a contact point
+func (c *DryRunClient) CreateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	current, err := c.contactPoint(ctx, contactPoint.Uid)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "POST", "/api/v1/provisioning/contact-points", current, contactPoint)
+	return nil
+}
+
+// plan updating a contact point
+func (c *DryRunClient) UpdateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	current, err := c.contactPoint(ctx, contactPoint.Uid)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/v1/provisioning/contact-points/"+contactPoint.Uid, current, contactPoint)
+	return nil
+}
+
+// plan deleting a contact point
+func (c *DryRunClient) DeleteContactPointContext(ctx context.Context, uid string) error {
+	current, err := c.contactPoint(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/v1/provisioning/contact-points/"+uid, "contact point not found")
+	}
+	c.plan(ctx, "DELETE", "/api/v1/provisioning/contact-points/"+uid, current, nil)
+	return nil
+}
+
+// plan replacing the notification policy tree
+func (c *DryRunClient) UpdatePolicyTreeContext(ctx context.Context, tree Route) error {
+	current, err := c.GetPolicyTreeContext(ctx)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/v1/provisioning/policies", current, tree)
+	return nil
+}
+
+// plan creating a mute timing
+func (c *DryRunClient) CreateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	current, err := c.muteTiming(ctx, muteTiming.Name)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "POST", "/api/v1/provisioning/mute-timings", current, muteTiming)
+	return nil
+}
+
+// plan updating a mute timing
+func (c *DryRunClient) UpdateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	current, err := c.muteTiming(ctx, muteTiming.Name)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/v1/provisioning/mute-timings/"+muteTiming.Name, current, muteTiming)
+	return nil
+}
+
+// plan deleting a mute timing
+func (c *DryRunClient) DeleteMuteTimingContext(ctx context.Context, name string) error {
+	current, err := c.muteTiming(ctx, name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/v1/provisioning/mute-timings/"+name, "mute timing not found")
+	}
+	c.plan(ctx, "DELETE", "/api/v1/provisioning/mute-timings/"+name, current, nil)
+	return nil
+}
+
+// plan creating or replacing a notification template
+func (c *DryRunClient) UpdateNotificationTemplateContext(ctx context.Context, template NotificationTemplate) error {
+	current, err := c.notificationTemplate(ctx, template.Name)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PUT", "/api/v1/provisioning/templates/"+template.Name, current, template)
+	return nil
+}
+
+// plan deleting a notification template
+func (c *DryRunClient) DeleteNotificationTemplateContext(ctx context.Context, name string) error {
+	current, err := c.notificationTemplate(ctx, name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/v1/provisioning/templates/"+name, "template not found")
+	}
+	c.plan(ctx, "DELETE", "/api/v1/provisioning/templates/"+name, current, nil)
+	return nil
+}
+
+// plan creating a library element
+func (c *DryRunClient) CreateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	current, err := c.libraryPanel(ctx, element.Uid)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "POST", "/api/library-elements", current, libraryElementPayload(element))
+	return nil
+}
+
+// plan updating a library element
+func (c *DryRunClient) UpdateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	current, err := c.libraryPanel(ctx, element.Uid)
+	if err != nil {
+		return err
+	}
+	c.plan(ctx, "PATCH", "/api/library-elements/"+element.Uid, current, libraryElementPayload(element))
+	return nil
+}
+
+// plan deleting a library element
+func (c *DryRunClient) DeleteLibraryElementContext(ctx context.Context, uid string) error {
+	current, err := c.libraryPanel(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("DELETE", "/api/library-elements/"+uid, "library element could not be found")
+	}
+	c.plan(ctx, "DELETE", "/api/library-elements/"+uid, current, nil)
+	return nil
+}
+
+// plan creating a folder, the returned folder has a placeholder id and uid
+func (c *DryRunClient) CreateFolderContext(ctx context.Context, folder Folder) (*Folder, error) {
+	c.plan(ctx, "POST", "/api/folders", nil, folder)
+	folder.Id, folder.Uid = c.placeholder()
+	return &folder, nil
+}
+
+// plan creating a user
+func (c *DryRunClient) CreateUserContext(ctx context.Context, user User) error {
+	c.plan(ctx, "POST", "/api/admin/users", nil, user)
+	return nil
+}
+
+// plan creating an organization, the returned organization has a placeholder id
+func (c *DryRunClient) CreateOrgContext(ctx context.Context, org Org) (*Org, error) {
+	c.plan(ctx, "POST", "/api/orgs", nil, org)
+	org.Id, _ = c.placeholder()
+	return &org, nil
+}
+
+// search the datasource matching a condition, nil if there is none
+func (c *DryRunClient) datasource(ctx context.Context, match func(Datasource) bool) (interface{}, error) {
+	dss, err := c.SearchDatasourceContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range dss {
+		if match(ds) {
+			return ds, nil
+		}
+	}
+	return nil, nil
+}
+
+// search the notification channel matching a condition, nil if there is none
+func (c *DryRunClient) notificationChannel(ctx context.Context, match func(NotificationChannel) bool) (interface{}, error) {
+	ncs, err := c.SearchNotificationChannelContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, nc := range ncs {
+		if match(nc) {
+			return nc, nil
+		}
+	}
+	return nil, nil
+}
+
+// return the contact point with the given uid or nil
+func (c *DryRunClient) contactPoint(ctx context.Context, uid string) (interface{}, error) {
+	contactPoints, err := c.SearchContactPointsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, contactPoint := range contactPoints {
+		if uid != "" && contactPoint.Uid == uid {
+			return contactPoint, nil
+		}
+	}
+	return nil, nil
+}
+
+// return the mute timing with the given name or nil
+func (c *DryRunClient) muteTiming(ctx context.Context, name string) (interface{}, error) {
+	muteTimings, err := c.SearchMuteTimingsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, muteTiming := range muteTimings {
+		if muteTiming.Name == name {
+			return muteTiming, nil
+		}
+	}
+	return nil, nil
+}
+
+// return the notification template with the given name or nil
+func (c *DryRunClient) notificationTemplate(ctx context.Context, name string) (interface{}, error) {
+	templates, err := c.SearchNotificationTemplatesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		if template.Name == name {
+			return template, nil
+		}
+	}
+	return nil, nil
+}
+
+// return the library panel with the given uid or nil
+func (c *DryRunClient) libraryPanel(ctx context.Context, uid string) (interface{}, error) {
+	elements, err := c.SearchLibraryPanelsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, element := range elements {
+		if element.Uid == uid {
+			return libraryElementPayload(element), nil
+		}
+	}
+	return nil, nil
+}
+
+// log a planned request with the diff between the current state and the payload, nil is an object which does not exist
+func (c *DryRunClient) plan(ctx context.Context, method string, endpoint string, current interface{}, desired interface{}) {
+	keyvals := []interface{}{"msg", "Dry run: planned " + method + " " + endpoint, "method", method, "endpoint", endpoint}
+	if orgId, ok := OrgIdFromContext(ctx); ok {
+		keyvals = append(keyvals, "orgId", orgId)
+	}
+	changes := diffPaths(current, desired)
+	if current != nil && desired != nil && len(changes) == 0 {
+		keyvals = append(keyvals, "diff", "no changes")
+	} else {
+		keyvals = append(keyvals, "diff", strings.Join(changes, ", "))
+	}
+	level.Info(c.logger).Log(keyvals...)
+}
+
+// return the fields of a library element which are saved, without those set by grafana
+func libraryElementPayload(element LibraryElement) LibraryElement {
+	element.Id, element.OrgId, element.Version = 0, 0, 0
+	element.Type, element.Description = "", ""
+	return element
+}
+
+// return the fields of a dashboard which are saved, without id and version set by grafana
+func dashboardPayload(dashboard Dashboard) map[string]interface{} {
+	model := make(map[string]interface{}, len(dashboard.Model))
+	for k, v := range dashboard.Model {
+		if k != "id" && k != "version" {
+			model[k] = v
+		}
+	}
+	return map[string]interface{}{"dashboard": model, "folderId": dashboard.FolderId}
+}
+
+// fields whose values are never logged
+var secretFields = map[string]bool{"password": true, "basicAuthPassword": true, "secureJsonData": true, "secureSettings": true,
+	"token": true, "apiKey": true, "integrationKey": true, "bottoken": true, "authorization_credentials": true}
+
+// settings of contact points and notification channels whose values are logged, the others are redacted as the secrets
+// among them like webhook urls and credentials depend on the integration type
+var publicSettings = map[string]bool{"addresses": true, "singleEmail": true, "message": true, "subject": true, "title": true,
+	"text": true, "description": true, "summary": true, "severity": true, "class": true, "component": true, "group": true,
+	"recipient": true, "username": true, "icon_emoji": true, "icon_url": true, "mentionChannel": true, "mentionUsers": true,
+	"mentionGroups": true, "httpMethod": true, "maxAlerts": true, "uploadImage": true, "autoResolve": true,
+	// the owner stamped by the controller
+	"grafanaConfigController": true}
+
+// redactedValue replaces the secure settings of contact points returned by grafana, the desired value of such a setting is never logged
+const redactedValue = "[REDACTED]"
+
+// return the changes from current to desired as json paths, prefixed with + for added, - for removed and ~ for changed values
+func diffPaths(current interface{}, desired interface{}) []string {
+	var changes []string
+	diff("", normalize(current), normalize(desired), &changes)
+	return changes
+}
+
+// convert a value to its generic json representation
+func normalize(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var n interface{}
+	if err = json.Unmarshal(b, &n); err != nil {
+		return string(b)
+	}
+	redact(n)
+	return n
+}
+
+// replace the values of secret fields in a generic json value
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			settings, isSettings := field.(map[string]interface{})
+			switch {
+			case secretFields[k]:
+				v[k] = "***"
+			case k == "settings" && isSettings:
+				redactSettings(settings)
+			default:
+				redact(field)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			redact(item)
+		}
+	}
+}
+
+// replace the values of the settings of a contact point or notification channel which are not public,
+// the secure settings grafana returns as [REDACTED] are kept to show that they are set
+func redactSettings(settings map[string]interface{}) {
+	for k, setting := range settings {
+		if !publicSettings[k] && setting != redactedValue {
+			settings[k] = "***"
+		}
+	}
+}
+
+// append the changes between two generic json values below path
+func diff(path string, current interface{}, desired interface{}, changes *[]string) {
+	currentMap, currentIsMap := current.(map[string]interface{})
+	desiredMap, desiredIsMap := desired.(map[string]interface{})
+	if (currentIsMap || current == nil) && (desiredIsMap || desired == nil) && (currentIsMap || desiredIsMap) {
+		keys := make([]string, 0, len(currentMap)+len(desiredMap))
+		for k := range currentMap {
+			keys = append(keys, k)
+		}
+		for k := range desiredMap {
+			if _, ok := currentMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if path == "" {
+				diff(k, currentMap[k], desiredMap[k], changes)
+			} else {
+				diff(path+"."+k, currentMap[k], desiredMap[k], changes)
+			}
+		}
+		return
+	}
+	currentSlice, currentIsSlice := current.([]interface{})
+	desiredSlice, desiredIsSlice := desired.([]interface{})
+	if currentIsSlice && desiredIsSlice {
+		for i := 0; i < len(currentSlice) || i < len(desiredSlice); i++ {
+			var c, d interface{}
+			if i < len(currentSlice) {
+				c = currentSlice[i]
+			}
+			if i < len(desiredSlice) {
+				d = desiredSlice[i]
+			}
+			diff(path+"["+strconv.Itoa(i)+"]", c, d, changes)
+		}
+		return
+	}
+	switch {
+	case reflect.DeepEqual(current, desired):
+	case current == redactedValue && desired != nil:
+		*changes = append(*changes, "~"+path+": "+compact(current)+" -> \"***\"")
+	case current == nil:
+		*changes = append(*changes, "+"+path+"="+compact(desired))
+	case desired == nil:
+		*changes = append(*changes, "-"+path+"="+compact(current))
+	default:
+		*changes = append(*changes, "~"+path+": "+compact(current)+" -> "+compact(desired))
+	}
+}
+
+// return the json of a generic value
+func compact(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,74 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned for every response of the grafana api with an unexpected status code
+type APIError struct {
+	// StatusCode is the http status code of the response
+	StatusCode int
+	// Status is the machine readable status grafana sends for some errors, e.g. "version-mismatch"
+	Status string
+	// Message is the error message sent by grafana or the raw response body if it is no grafana error
+	Message string
+	// Method and Endpoint of the failed request
+	Method   string
+	Endpoint string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Unexpected status code returned from Grafana API (method: %s, endpoint: %s, got: %d, msg: %s)", e.Method, e.Endpoint, e.StatusCode, e.Message)
+}
+
+// build an APIError from the failed request and its response body
+func newAPIError(req *http.Request, statusCode int, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: statusCode,
+		Method:     req.Method,
+		Endpoint:   req.URL.Path,
+	}
+	var grafanaErr struct {
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &grafanaErr); err == nil && grafanaErr.Message != "" {
+		apiErr.Message = grafanaErr.Message
+		apiErr.Status = grafanaErr.Status
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// return the status code of an APIError or 0 for any other error
+func StatusCode(err error) int {
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// the requested object does not exist
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// the object already exists, e.g. a datasource or folder with the same name
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+// the object was changed in between or a dashboard with the same name exists in the folder
+func IsPreconditionFailed(err error) bool {
+	return StatusCode(err) == http.StatusPreconditionFailed
+}
+
+// the controller is not authenticated or not allowed to do the request
+func IsUnauthorized(err error) bool {
+	code := StatusCode(err)
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
@@ -15,16 +15,15 @@
 package grafana
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -35,224 +34,379 @@ type APIClient struct {
 	BaseUrl    *url.URL
 	HTTPClient *http.Client
 	Id         int
-	logger     log.Logger
+	// Timeout limits a whole api call including all retries, 0 means no limit
+	Timeout time.Duration
+	// RequestTimeout limits every single http request sent to grafana, 0 means no limit
+	RequestTimeout time.Duration
+	// RetryPolicy decides which failed requests are sent again, nil disables retries
+	RetryPolicy RetryPolicy
+	// Auth adds the credentials to every request, nil sends requests unauthenticated
+	Auth   Authenticator
+	logger log.Logger
+
+	mtx          sync.Mutex
+	capabilities *Capabilities
 }
 
-type GrafanaDashboard struct {
-	Id       int    `json:"id"`
-	Title    string `json:"title"`
-	Uri      string `json:"uri"`
-	Uid      string `json:"uid"`
-	Type     string `json:"type"`
-	FolderId int    `json:"folderId"`
-}
-
-type GrafanaDashboardConfigmap struct {
-	Dashboard struct{ Title string } `json:"dashboard"`
-	FolderId  int                    `json:"folderId"`
+// return a list of grafana dashboards
+func (c *APIClient) SearchDashboard() ([]SearchHit, error) {
+	return c.SearchDashboardContext(context.Background())
 }
 
-// return a list of grafana dashboards
-func (c *APIClient) SearchDashboard() ([]GrafanaDashboard, error) {
-	searchUrl := makeUrl(c.BaseUrl, "/api/search")
-	resp, err := c.HTTPClient.Get(searchUrl)
+func (c *APIClient) SearchDashboardContext(ctx context.Context) ([]SearchHit, error) {
+	searchResult := make([]SearchHit, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/search"), &searchResult)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return searchResult, nil
+}
+
+// return a dashboard with its metadata
+func (c *APIClient) GetDashboard(uid string) (*Dashboard, error) {
+	return c.GetDashboardContext(context.Background(), uid)
+}
 
-	searchResult := make([]GrafanaDashboard, 0)
-	err = json.NewDecoder(resp.Body).Decode(&searchResult)
+func (c *APIClient) GetDashboardContext(ctx context.Context, uid string) (*Dashboard, error) {
+	dashboard := &Dashboard{}
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/dashboards/uid/"+uid), dashboard)
 	if err != nil {
 		return nil, err
 	}
-
-	return searchResult, nil
+	return dashboard, nil
 }
 
 // return a list of grafana datasources
-func (c *APIClient) SearchDatasource() ([]map[string]interface{}, error) {
-	searchUrl := makeUrl(c.BaseUrl, "/api/datasources")
-	resp, err := c.HTTPClient.Get(searchUrl)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+func (c *APIClient) SearchDatasource() ([]Datasource, error) {
+	return c.SearchDatasourceContext(context.Background())
+}
 
-	searchResult := make([]map[string]interface{}, 0)
-	err = json.NewDecoder(resp.Body).Decode(&searchResult)
+func (c *APIClient) SearchDatasourceContext(ctx context.Context) ([]Datasource, error) {
+	searchResult := make([]Datasource, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/datasources"), &searchResult)
 	if err != nil {
 		level.Error(c.logger).Log("err", err.Error())
 		return nil, err
 	}
-
 	return searchResult, nil
 }
 
-//return a list of notification channels
-func (c *APIClient) SearchNotificationChannel() ([]map[string]interface{}, error) {
-	searchUrl := makeUrl(c.BaseUrl, "/api/alert-notifications")
-	resp, err := c.HTTPClient.Get(searchUrl)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// return a list of notification channels
+func (c *APIClient) SearchNotificationChannel() ([]NotificationChannel, error) {
+	return c.SearchNotificationChannelContext(context.Background())
+}
 
-	searchResult := make([]map[string]interface{}, 0)
-	err = json.NewDecoder(resp.Body).Decode(&searchResult)
+func (c *APIClient) SearchNotificationChannelContext(ctx context.Context) ([]NotificationChannel, error) {
+	searchResult := make([]NotificationChannel, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/alert-notifications"), &searchResult)
 	if err != nil {
 		level.Error(c.logger).Log("err", err.Error())
 		return nil, err
 	}
-
 	return searchResult, nil
 }
 
 // return a list of folders
-func (c *APIClient) SearchFolder() ([]map[string]interface{}, error) {
-	searchUrl := makeUrl(c.BaseUrl, "/api/folders")
-	resp, err := c.HTTPClient.Get(searchUrl)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+func (c *APIClient) SearchFolder() ([]Folder, error) {
+	return c.SearchFolderContext(context.Background())
+}
 
-	searchResult := make([]map[string]interface{}, 0)
-	err = json.NewDecoder(resp.Body).Decode(&searchResult)
+func (c *APIClient) SearchFolderContext(ctx context.Context) ([]Folder, error) {
+	searchResult := make([]Folder, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/folders"), &searchResult)
 	if err != nil {
 		level.Error(c.logger).Log("err", err.Error())
 		return nil, err
 	}
-
 	return searchResult, nil
 }
 
 func (c *APIClient) DeleteDashboard(uid string) error {
+	return c.DeleteDashboardContext(context.Background(), uid)
+}
 
-	deleteUrl := makeUrl(c.BaseUrl, "/api/dashboards/uid/"+uid)
-	req, err := http.NewRequest("DELETE", deleteUrl, nil)
-	if err != nil {
-		return err
-	}
+func (c *APIClient) DeleteDashboardContext(ctx context.Context, uid string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/dashboards/uid/"+uid))
+}
 
-	return c.doRequest(req)
+func (c *APIClient) DeleteDatasource(name string) error {
+	return c.DeleteDatasourceContext(context.Background(), name)
 }
 
-func (c *APIClient) DeleteDatasource(datasourceJSON io.Reader) error {
-	datasource := make(map[string]interface{})
-	err := json.NewDecoder(datasourceJSON).Decode(&datasource)
-	if err != nil {
-		level.Error(c.logger).Log("err", err.Error())
-	}
-	deleteUrl := makeUrl(c.BaseUrl, "/api/datasources/name/"+datasource["name"].(string))
-	req, err := http.NewRequest("DELETE", deleteUrl, nil)
+func (c *APIClient) DeleteDatasourceContext(ctx context.Context, name string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/datasources/name/"+name))
+}
+
+func (c *APIClient) DeleteNotificationChannel(id int) error {
+	return c.DeleteNotificationChannelContext(context.Background(), id)
+}
+
+func (c *APIClient) DeleteNotificationChannelContext(ctx context.Context, id int) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/alert-notifications/"+strconv.Itoa(id)))
+}
+
+func (c *APIClient) UpdateDatasource(datasource Datasource) error {
+	return c.UpdateDatasourceContext(context.Background(), datasource)
+}
+
+func (c *APIClient) UpdateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	updateUrl := makeUrl(c.BaseUrl, "/api/datasources/"+strconv.Itoa(datasource.Id))
+	return c.doPut(ctx, updateUrl, datasource, nil)
+}
+
+func (c *APIClient) UpdateNotificationChannel(notificationChannel NotificationChannel) error {
+	return c.UpdateNotificationChannelContext(context.Background(), notificationChannel)
+}
+
+func (c *APIClient) UpdateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	updateUrl := makeUrl(c.BaseUrl, "/api/alert-notifications/"+strconv.Itoa(notificationChannel.Id))
+	return c.doPut(ctx, updateUrl, notificationChannel, nil)
+}
+
+func (c *APIClient) CreateDashboard(dashboard Dashboard) (*DashboardSaveResult, error) {
+	return c.CreateDashboardContext(context.Background(), dashboard)
+}
+
+func (c *APIClient) CreateDashboardContext(ctx context.Context, dashboard Dashboard) (*DashboardSaveResult, error) {
+	result := &DashboardSaveResult{}
+	err := c.doPost(ctx, makeUrl(c.BaseUrl, "/api/dashboards/db"), dashboard, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return result, nil
+}
 
-	return c.doRequest(req)
+func (c *APIClient) CreateDatasource(datasource Datasource) error {
+	return c.CreateDatasourceContext(context.Background(), datasource)
 }
 
-func (c *APIClient) DeleteNotificationChannel(id int) error {
+func (c *APIClient) CreateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/datasources"), datasource, nil)
+}
+
+func (c *APIClient) CreateNotificationChannel(notificationChannel NotificationChannel) error {
+	return c.CreateNotificationChannelContext(context.Background(), notificationChannel)
+}
 
-	deleteUrl := makeUrl(c.BaseUrl, "/api/alert-notifications/"+strconv.Itoa(id))
-	req, err := http.NewRequest("DELETE", deleteUrl, nil)
+func (c *APIClient) CreateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/alert-notifications"), notificationChannel, nil)
+}
+
+func (c *APIClient) CreateFolder(folder Folder) (*Folder, error) {
+	return c.CreateFolderContext(context.Background(), folder)
+}
+
+func (c *APIClient) CreateFolderContext(ctx context.Context, folder Folder) (*Folder, error) {
+	result := &Folder{}
+	err := c.doPost(ctx, makeUrl(c.BaseUrl, "/api/folders"), folder, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return result, nil
+}
 
-	return c.doRequest(req)
+func (c *APIClient) CreateUser(user User) error {
+	return c.CreateUserContext(context.Background(), user)
 }
 
-func (c *APIClient) UpdateDatasource(id int, datasourceJson io.Reader) error {
-	updateUrl := makeUrl(c.BaseUrl, "/api/datasources/"+strconv.Itoa(id))
-	return c.doPut(updateUrl, datasourceJson)
+func (c *APIClient) CreateUserContext(ctx context.Context, user User) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/admin/users"), user, nil)
 }
 
-func (c *APIClient) UpdateNotificationChannel(id int, notificationChannelJSON io.Reader) error {
-	updateUrl := makeUrl(c.BaseUrl, "/api/alert-notifications/"+strconv.Itoa(id))
-	return c.doPut(updateUrl, notificationChannelJSON)
+// return all organizations, needs a server admin
+func (c *APIClient) SearchOrgs() ([]Org, error) {
+	return c.SearchOrgsContext(context.Background())
 }
 
-func (c *APIClient) CreateDashboard(dashboardJSON io.Reader) error {
-	return c.doPost(makeUrl(c.BaseUrl, "/api/dashboards/db"), dashboardJSON)
+func (c *APIClient) SearchOrgsContext(ctx context.Context) ([]Org, error) {
+	orgs := make([]Org, 0)
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/orgs"), &orgs)
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
 }
 
-func (c *APIClient) CreateDatasource(datasourceJSON io.Reader) error {
-	return c.doPost(makeUrl(c.BaseUrl, "/api/datasources"), datasourceJSON)
+// return the organization with the given name
+func (c *APIClient) GetOrgByName(name string) (*Org, error) {
+	return c.GetOrgByNameContext(context.Background(), name)
 }
 
-func (c *APIClient) CreateNotificationChannel(notificationChannelJSON io.Reader) error {
-	return c.doPost(makeUrl(c.BaseUrl, "/api/alert-notifications"), notificationChannelJSON)
+func (c *APIClient) GetOrgByNameContext(ctx context.Context, name string) (*Org, error) {
+	org := &Org{}
+	err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/orgs/name/"+name), org)
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
 }
 
-func (c *APIClient) CreateFolder(folderJSON io.Reader) error {
-	return c.doPost(makeUrl(c.BaseUrl, "/api/folders"), folderJSON)
+func (c *APIClient) CreateOrg(org Org) (*Org, error) {
+	return c.CreateOrgContext(context.Background(), org)
 }
 
-func (c *APIClient) CreateUser(userJSON io.Reader) error {
-	return c.doPost(makeUrl(c.BaseUrl, "/api/admin/users"), userJSON)
+func (c *APIClient) CreateOrgContext(ctx context.Context, org Org) (*Org, error) {
+	result := struct {
+		OrgId int `json:"orgId"`
+	}{}
+	err := c.doPost(ctx, makeUrl(c.BaseUrl, "/api/orgs"), org, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &Org{Id: result.OrgId, Name: org.Name}, nil
 }
 
-func (c *APIClient) doPut(url string, dataJSON io.Reader) error {
-	req, err := http.NewRequest("PUT", url, dataJSON)
+func (c *APIClient) doGet(ctx context.Context, url string, result interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	if os.Getenv("GRAFANA_BEARER_TOKEN") != "" {
-		req.Header.Add("Authorization", "Bearer "+os.Getenv("GRAFANA_BEARER_TOKEN"))
+	return c.doRequest(ctx, req, result)
+}
+
+func (c *APIClient) doDelete(ctx context.Context, url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
 	}
-	return c.doRequest(req)
+	return c.doRequest(ctx, req, nil)
 }
 
-func (c *APIClient) doPost(url string, dataJSON io.Reader) error {
-	req, err := http.NewRequest("POST", url, dataJSON)
+func (c *APIClient) doPut(ctx context.Context, url string, data interface{}, result interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(dataJSON))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	return c.doRequest(ctx, req, result)
+}
 
-	if os.Getenv("GRAFANA_BEARER_TOKEN") != "" {
-		req.Header.Add("Authorization", "Bearer "+os.Getenv("GRAFANA_BEARER_TOKEN"))
+func (c *APIClient) doPost(ctx context.Context, url string, data interface{}, result interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
 	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(dataJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
 
-	return c.doRequest(req)
+	return c.doRequest(ctx, req, result)
 }
 
-func (c *APIClient) doRequest(req *http.Request) error {
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		for strings.Contains(err.Error(), "connection refused") {
-			level.Error(c.logger).Log("err", err.Error())
-			level.Info(c.logger).Log("msg", "Perhaps Grafana is not ready. Waiting for 8 seconds and retry again...")
-			time.Sleep(8 * time.Second)
-			resp, err = c.HTTPClient.Do(req)
-			if err == nil {
-				break
-			}
+// send the request, retry it according to the retry policy and decode the response body into result if result is not nil
+func (c *APIClient) doRequest(ctx context.Context, req *http.Request, result interface{}) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var resp *http.Response
+	var response []byte
+	var err error
+	for attempt := 1; ; attempt++ {
+		resp, response, err = c.send(ctx, req)
+		if err == nil && successful(resp.StatusCode) {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// a request body which cannot be rewound must not be sent again
+		if c.RetryPolicy == nil || (req.Body != nil && req.GetBody == nil) {
+			break
+		}
+		wait, retry := c.RetryPolicy.Retry(req, resp, err, attempt)
+		if !retry {
+			break
+		}
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Grafana API request failed, retrying in "+wait.String(), "method", req.Method, "url", req.URL.Path, "attempt", attempt, "err", err.Error())
+		} else {
+			level.Warn(c.logger).Log("msg", "Grafana API request failed, retrying in "+wait.String(), "method", req.Method, "url", req.URL.Path, "attempt", attempt, "status", resp.StatusCode)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
 		}
 	}
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	response, _ := ioutil.ReadAll(resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Unexpected status code returned from Grafana API (got: %d, expected: 200, msg:%s)", resp.StatusCode, string(response))
+	if !successful(resp.StatusCode) {
+		return newAPIError(req, resp.StatusCode, response)
+	}
+	// grafana answers some requests with 204 No Content or an empty 202 Accepted
+	if result != nil && len(bytes.TrimSpace(response)) > 0 {
+		return json.Unmarshal(response, result)
 	}
 	return nil
 }
 
+// return if the status code is a 2xx success, grafana answers creations with 201 and provisioning requests with 202 or 204
+func successful(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// send a single http request limited by RequestTimeout and return the response with its read body
+func (c *APIClient) send(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	attempt := req.WithContext(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, nil, err
+		}
+		attempt.Body = body
+	}
+	// copy the header, so a rotated credential replaces the one of the previous attempt
+	attempt.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		attempt.Header[k] = v
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Authenticate(attempt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if orgId, ok := OrgIdFromContext(ctx); ok {
+		attempt.Header.Set("X-Grafana-Org-Id", strconv.Itoa(orgId))
+	}
+
+	resp, err := c.HTTPClient.Do(attempt)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, response, nil
+}
+
 // return a new APIClient
 func New(baseUrl *url.URL, id int, logger log.Logger) *APIClient {
 	return &APIClient{
-		BaseUrl:    baseUrl,
-		HTTPClient: http.DefaultClient,
-		Id:         id,
-		logger:     logger,
+		BaseUrl:     baseUrl,
+		HTTPClient:  &http.Client{},
+		Id:          id,
+		RetryPolicy: DefaultRetryPolicy(),
+		logger:      logger,
 	}
 }
 
@@ -0,0 +1,438 @@
+// Package grafanatest provides a fake grafana http api for tests of the grafana package and its users.
+package grafanatest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log"
+)
+
+// Server is an httptest.Server emulating the grafana api endpoints used by grafana.APIClient,
+// its state is kept in a grafana.MemoryClient
+type Server struct {
+	*httptest.Server
+	// Grafana holds the state of the server, its Errors are answered with their status code
+	Grafana *grafana.MemoryClient
+	// Token, User and Password are the accepted credentials, requests are not checked if all are empty
+	Token    string
+	User     string
+	Password string
+
+	mtx           sync.Mutex
+	requests      []Request
+	failures      int
+	failureStatus int
+}
+
+// Request is a request received by the Server
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// start a new Server
+func NewServer() *Server {
+	s := &Server{Grafana: grafana.NewMemoryClient()}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// start a new Server serving https
+func NewTLSServer() *Server {
+	s := &Server{Grafana: grafana.NewMemoryClient()}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// return the url of the server
+func (s *Server) BaseUrl() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+// return an APIClient talking to the server with its credentials
+func (s *Server) APIClient(logger log.Logger) *grafana.APIClient {
+	c := grafana.New(s.BaseUrl(), 0, logger)
+	c.HTTPClient = s.Client()
+	switch {
+	case s.Token != "":
+		c.Auth = &grafana.TokenAuth{Token: s.Token}
+	case s.User != "":
+		c.Auth = &grafana.BasicAuth{User: s.User, Password: s.Password}
+	}
+	return c
+}
+
+// answer the next n requests with the given status code, e.g. to test retries
+func (s *Server) FailRequests(n int, statusCode int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.failures = n
+	s.failureStatus = statusCode
+}
+
+// return all received requests
+func (s *Server) Requests() []Request {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mtx.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: body})
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mtx.Unlock()
+
+	if fail {
+		writeError(w, s.failureStatus, http.StatusText(s.failureStatus))
+		return
+	}
+	if !s.authenticated(r) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	ctx := r.Context()
+	if org := r.Header.Get("X-Grafana-Org-Id"); org != "" {
+		orgId, err := strconv.Atoi(org)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid X-Grafana-Org-Id")
+			return
+		}
+		ctx = grafana.WithOrgId(ctx, orgId)
+	}
+
+	result, err := s.route(ctx, r.Method, r.URL.Path, r.URL.Query(), body)
+	if err != nil {
+		if apiErr, ok := err.(*grafana.APIError); ok {
+			writeError(w, apiErr.StatusCode, apiErr.Message)
+		} else {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	statusCode := http.StatusOK
+	if r, ok := result.(response); ok {
+		statusCode, result = r.statusCode, r.body
+	}
+	if result == nil && statusCode == http.StatusNoContent {
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(result)
+}
+
+// call the MemoryClient according to the endpoint and return the response body
+func (s *Server) route(ctx context.Context, method string, path string, query url.Values, body []byte) (interface{}, error) {
+	g := s.Grafana
+	switch {
+	case method == "GET" && path == "/api/health":
+		capabilities, err := g.DetectCapabilitiesContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"commit": "grafanatest", "database": "ok", "version": capabilities.Version}, nil
+	case method == "GET" && path == "/api/frontend/settings":
+		capabilities, err := g.DetectCapabilitiesContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"alertingEnabled":        capabilities.LegacyAlerting,
+			"unifiedAlertingEnabled": capabilities.UnifiedAlerting,
+			"featureToggles":         map[string]bool{"nestedFolders": capabilities.NestedFolders},
+			"buildInfo":              map[string]string{"version": capabilities.Version},
+		}, nil
+
+	case method == "GET" && path == "/api/search":
+		return g.SearchDashboardContext(ctx)
+
+	case method == "POST" && path == "/api/dashboards/db":
+		var dh grafana.Dashboard
+		if err := decode(body, &dh); err != nil {
+			return nil, err
+		}
+		return g.CreateDashboardContext(ctx, dh)
+	case method == "GET" && strings.HasPrefix(path, "/api/dashboards/uid/"):
+		return g.GetDashboardContext(ctx, strings.TrimPrefix(path, "/api/dashboards/uid/"))
+	case method == "DELETE" && strings.HasPrefix(path, "/api/dashboards/uid/"):
+		return message("Dashboard deleted"), g.DeleteDashboardContext(ctx, strings.TrimPrefix(path, "/api/dashboards/uid/"))
+
+	case method == "GET" && path == "/api/datasources":
+		return g.SearchDatasourceContext(ctx)
+	case method == "POST" && path == "/api/datasources":
+		var ds grafana.Datasource
+		if err := decode(body, &ds); err != nil {
+			return nil, err
+		}
+		return message("Datasource added"), g.CreateDatasourceContext(ctx, ds)
+	case method == "PUT" && strings.HasPrefix(path, "/api/datasources/"):
+		var ds grafana.Datasource
+		if err := decode(body, &ds); err != nil {
+			return nil, err
+		}
+		id, err := pathId(path, "/api/datasources/")
+		if err != nil {
+			return nil, err
+		}
+		ds.Id = id
+		return message("Datasource updated"), g.UpdateDatasourceContext(ctx, ds)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/datasources/name/"):
+		return message("Data source deleted"), g.DeleteDatasourceContext(ctx, strings.TrimPrefix(path, "/api/datasources/name/"))
+
+	case method == "GET" && path == "/api/alert-notifications":
+		return g.SearchNotificationChannelContext(ctx)
+	case method == "POST" && path == "/api/alert-notifications":
+		var nc grafana.NotificationChannel
+		if err := decode(body, &nc); err != nil {
+			return nil, err
+		}
+		return message("Alert notification created"), g.CreateNotificationChannelContext(ctx, nc)
+	case method == "PUT" && strings.HasPrefix(path, "/api/alert-notifications/"):
+		var nc grafana.NotificationChannel
+		if err := decode(body, &nc); err != nil {
+			return nil, err
+		}
+		id, err := pathId(path, "/api/alert-notifications/")
+		if err != nil {
+			return nil, err
+		}
+		nc.Id = id
+		return message("Alert notification updated"), g.UpdateNotificationChannelContext(ctx, nc)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/alert-notifications/"):
+		id, err := pathId(path, "/api/alert-notifications/")
+		if err != nil {
+			return nil, err
+		}
+		return message("Notification deleted"), g.DeleteNotificationChannelContext(ctx, id)
+
+	case method == "GET" && path == "/api/folders":
+		return g.SearchFolderContext(ctx)
+	case method == "POST" && path == "/api/folders":
+		var fd grafana.Folder
+		if err := decode(body, &fd); err != nil {
+			return nil, err
+		}
+		return g.CreateFolderContext(ctx, fd)
+
+	case method == "GET" && path == "/api/v1/provisioning/alert-rules":
+		return g.SearchAlertRulesContext(ctx)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/v1/provisioning/alert-rules/"):
+		return noContent(), g.DeleteAlertRuleContext(ctx, strings.TrimPrefix(path, "/api/v1/provisioning/alert-rules/"))
+	case strings.HasPrefix(path, "/api/v1/provisioning/folder/") && strings.Contains(path, "/rule-groups/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/api/v1/provisioning/folder/"), "/rule-groups/", 2)
+		switch method {
+		case "GET":
+			return g.GetAlertRuleGroupContext(ctx, parts[0], parts[1])
+		case "PUT":
+			var group grafana.AlertRuleGroup
+			if err := decode(body, &group); err != nil {
+				return nil, err
+			}
+			group.FolderUid, group.Title = parts[0], parts[1]
+			return g.UpdateAlertRuleGroupContext(ctx, group)
+		}
+
+	case method == "GET" && path == "/api/v1/provisioning/contact-points":
+		return g.SearchContactPointsContext(ctx)
+	case method == "POST" && path == "/api/v1/provisioning/contact-points":
+		var contactPoint grafana.ContactPoint
+		if err := decode(body, &contactPoint); err != nil {
+			return nil, err
+		}
+		return accepted(contactPoint), g.CreateContactPointContext(ctx, contactPoint)
+	case method == "PUT" && strings.HasPrefix(path, "/api/v1/provisioning/contact-points/"):
+		var contactPoint grafana.ContactPoint
+		if err := decode(body, &contactPoint); err != nil {
+			return nil, err
+		}
+		contactPoint.Uid = strings.TrimPrefix(path, "/api/v1/provisioning/contact-points/")
+		return accepted(contactPoint), g.UpdateContactPointContext(ctx, contactPoint)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/v1/provisioning/contact-points/"):
+		return accepted(message("contactpoint deleted")), g.DeleteContactPointContext(ctx, strings.TrimPrefix(path, "/api/v1/provisioning/contact-points/"))
+
+	case method == "GET" && path == "/api/v1/provisioning/policies":
+		return g.GetPolicyTreeContext(ctx)
+	case method == "PUT" && path == "/api/v1/provisioning/policies":
+		var tree grafana.Route
+		if err := decode(body, &tree); err != nil {
+			return nil, err
+		}
+		return accepted(message("policies updated")), g.UpdatePolicyTreeContext(ctx, tree)
+
+	case method == "GET" && path == "/api/v1/provisioning/mute-timings":
+		return g.SearchMuteTimingsContext(ctx)
+	case method == "POST" && path == "/api/v1/provisioning/mute-timings":
+		var muteTiming grafana.MuteTiming
+		if err := decode(body, &muteTiming); err != nil {
+			return nil, err
+		}
+		return created(muteTiming), g.CreateMuteTimingContext(ctx, muteTiming)
+	case method == "PUT" && strings.HasPrefix(path, "/api/v1/provisioning/mute-timings/"):
+		var muteTiming grafana.MuteTiming
+		if err := decode(body, &muteTiming); err != nil {
+			return nil, err
+		}
+		muteTiming.Name = strings.TrimPrefix(path, "/api/v1/provisioning/mute-timings/")
+		return accepted(muteTiming), g.UpdateMuteTimingContext(ctx, muteTiming)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/v1/provisioning/mute-timings/"):
+		return noContent(), g.DeleteMuteTimingContext(ctx, strings.TrimPrefix(path, "/api/v1/provisioning/mute-timings/"))
+
+	case method == "GET" && path == "/api/v1/provisioning/templates":
+		return g.SearchNotificationTemplatesContext(ctx)
+	case method == "PUT" && strings.HasPrefix(path, "/api/v1/provisioning/templates/"):
+		var template grafana.NotificationTemplate
+		if err := decode(body, &template); err != nil {
+			return nil, err
+		}
+		template.Name = strings.TrimPrefix(path, "/api/v1/provisioning/templates/")
+		return accepted(template), g.UpdateNotificationTemplateContext(ctx, template)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/v1/provisioning/templates/"):
+		return noContent(), g.DeleteNotificationTemplateContext(ctx, strings.TrimPrefix(path, "/api/v1/provisioning/templates/"))
+
+	case method == "GET" && path == "/api/library-elements":
+		elements, err := g.SearchLibraryPanelsContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page, perPage := queryInt(query, "page", 1), queryInt(query, "perPage", 100)
+		from, to := (page-1)*perPage, page*perPage
+		if from > len(elements) {
+			from = len(elements)
+		}
+		if to > len(elements) {
+			to = len(elements)
+		}
+		return result(map[string]interface{}{"totalCount": len(elements), "elements": elements[from:to], "page": page, "perPage": perPage}), nil
+	case method == "POST" && path == "/api/library-elements":
+		var element grafana.LibraryElement
+		if err := decode(body, &element); err != nil {
+			return nil, err
+		}
+		return result(element), g.CreateLibraryElementContext(ctx, element)
+	case method == "PATCH" && strings.HasPrefix(path, "/api/library-elements/"):
+		var element grafana.LibraryElement
+		if err := decode(body, &element); err != nil {
+			return nil, err
+		}
+		element.Uid = strings.TrimPrefix(path, "/api/library-elements/")
+		return result(element), g.UpdateLibraryElementContext(ctx, element)
+	case method == "DELETE" && strings.HasPrefix(path, "/api/library-elements/"):
+		return message("Library element deleted"), g.DeleteLibraryElementContext(ctx, strings.TrimPrefix(path, "/api/library-elements/"))
+
+	case method == "POST" && path == "/api/admin/users":
+		var user grafana.User
+		if err := decode(body, &user); err != nil {
+			return nil, err
+		}
+		return message("User created"), g.CreateUserContext(ctx, user)
+
+	case method == "GET" && path == "/api/orgs":
+		return g.SearchOrgsContext(ctx)
+	case method == "GET" && strings.HasPrefix(path, "/api/orgs/name/"):
+		return g.GetOrgByNameContext(ctx, strings.TrimPrefix(path, "/api/orgs/name/"))
+	case method == "POST" && path == "/api/orgs":
+		var org grafana.Org
+		if err := decode(body, &org); err != nil {
+			return nil, err
+		}
+		created, err := g.CreateOrgContext(ctx, org)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"orgId": created.Id, "message": "Organization created"}, nil
+	}
+	return nil, &grafana.APIError{StatusCode: http.StatusNotFound, Message: "Not found"}
+}
+
+// check the credentials if the server has some
+func (s *Server) authenticated(r *http.Request) bool {
+	if s.Token == "" && s.User == "" {
+		return true
+	}
+	if s.Token != "" && r.Header.Get("Authorization") == "Bearer "+s.Token {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	return s.User != "" && ok && user == s.User && password == s.Password
+}
+
+func decode(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &grafana.APIError{StatusCode: http.StatusBadRequest, Message: "bad request data"}
+	}
+	return nil
+}
+
+func pathId(path string, prefix string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(path, prefix))
+	if err != nil {
+		return 0, &grafana.APIError{StatusCode: http.StatusBadRequest, Message: "id is invalid"}
+	}
+	return id, nil
+}
+
+// return a positive integer query parameter or def if it is missing or invalid
+func queryInt(query url.Values, key string, def int) int {
+	if v, err := strconv.Atoi(query.Get(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// wrap a response body like the library elements api does
+func result(v interface{}) map[string]interface{} {
+	return map[string]interface{}{"result": v}
+}
+
+// a response body sent with another status code than 200
+type response struct {
+	statusCode int
+	body       interface{}
+}
+
+// answer with 201 Created like grafana does for new mute timings
+func created(body interface{}) response {
+	return response{statusCode: http.StatusCreated, body: body}
+}
+
+// answer with 202 Accepted like grafana does for most provisioning requests
+func accepted(body interface{}) response {
+	return response{statusCode: http.StatusAccepted, body: body}
+}
+
+// answer with an empty 204 No Content like grafana does for deleted alert rules, mute timings and templates
+func noContent() response {
+	return response{statusCode: http.StatusNoContent}
+}
+
+func message(msg string) map[string]string {
+	return map[string]string{"message": msg}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(message(msg))
+}
@@ -0,0 +1,467 @@
+package grafanatest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dbsystel/grafana-config-controller/grafana"
+	"github.com/go-kit/kit/log"
+)
+
+// return a server and a client talking to it which retries quickly
+func newTestServer(t *testing.T) (*Server, *grafana.APIClient) {
+	s := NewServer()
+	c := s.APIClient(log.NewNopLogger())
+	c.RetryPolicy = &grafana.BackoffPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}
+	return s, c
+}
+
+func TestDashboardRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	dh := grafana.Dashboard{Model: map[string]interface{}{"title": "Nodes", "uid": "nodes", "tags": []interface{}{"k8s"}}}
+	result, err := c.CreateDashboard(dh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uid != "nodes" || result.Version != 1 {
+		t.Fatalf("unexpected save result %+v", result)
+	}
+
+	hits, err := c.SearchDashboard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Uid != "nodes" || hits[0].Title != "Nodes" || len(hits[0].Tags) != 1 {
+		t.Fatalf("unexpected search result %+v", hits)
+	}
+
+	// saving again without overwrite and with an old version is refused
+	if _, err = c.CreateDashboard(dh); !grafana.IsPreconditionFailed(err) {
+		t.Fatalf("expected precondition failed, got %v", err)
+	}
+	dh.Model["title"] = "Nodes v2"
+	dh.Overwrite = true
+	if result, err = c.CreateDashboard(dh); err != nil {
+		t.Fatal(err)
+	}
+	if result.Version != 2 {
+		t.Fatalf("expected version 2, got %d", result.Version)
+	}
+
+	got, err := c.GetDashboard("nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title() != "Nodes v2" || got.Version() != 2 || got.Meta == nil || got.Meta.Url == "" {
+		t.Fatalf("unexpected dashboard %+v", got)
+	}
+
+	if err = c.DeleteDashboard("nodes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.GetDashboard("nodes"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err = c.DeleteDashboard("nodes"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestDashboardInFolder(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	fd, err := c.CreateFolder(grafana.Folder{Title: "monitoring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd.Id == 0 || fd.Uid == "" {
+		t.Fatalf("folder has no id or uid: %+v", fd)
+	}
+	if _, err = c.CreateFolder(grafana.Folder{Title: "Monitoring"}); !grafana.IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if _, err = c.CreateDashboard(grafana.Dashboard{Model: map[string]interface{}{"title": "Pods"}, FolderId: fd.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.CreateDashboard(grafana.Dashboard{Model: map[string]interface{}{"title": "Pods"}, FolderId: 4711}); grafana.StatusCode(err) != http.StatusBadRequest {
+		t.Fatalf("expected bad request for a missing folder, got %v", err)
+	}
+
+	hits, err := c.SearchDashboard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, hit := range hits {
+		if hit.Type == "dash-db" {
+			found = hit.FolderId == fd.Id && hit.FolderUid == fd.Uid && hit.FolderTitle == "monitoring"
+		}
+	}
+	if !found {
+		t.Fatalf("dashboard not found in folder: %+v", hits)
+	}
+}
+
+func TestDatasourceRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	ds := grafana.Datasource{Name: "prometheus", Type: "prometheus", Access: "proxy", Url: "http://prometheus:9090"}
+	if err := c.CreateDatasource(ds); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDatasource(ds); !grafana.IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	dss, err := c.SearchDatasource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dss) != 1 || dss[0].Id == 0 || dss[0].Uid == "" || dss[0].Url != ds.Url {
+		t.Fatalf("unexpected datasources %+v", dss)
+	}
+
+	updated := dss[0]
+	updated.Url = "http://thanos:9090"
+	if err = c.UpdateDatasource(updated); err != nil {
+		t.Fatal(err)
+	}
+	if dss, err = c.SearchDatasource(); err != nil {
+		t.Fatal(err)
+	}
+	if dss[0].Url != "http://thanos:9090" || dss[0].Uid != updated.Uid {
+		t.Fatalf("datasource not updated: %+v", dss[0])
+	}
+	updated.Id = 4711
+	if err = c.UpdateDatasource(updated); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err = c.DeleteDatasource("prometheus"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteDatasource("prometheus"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestNotificationChannelRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	nc := grafana.NotificationChannel{Name: "team", Type: "email", Settings: map[string]interface{}{"addresses": "team@example.com"}}
+	if err := c.CreateNotificationChannel(nc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateNotificationChannel(nc); !grafana.IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	ncs, err := c.SearchNotificationChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ncs) != 1 || ncs[0].Id == 0 || ncs[0].Settings["addresses"] != "team@example.com" {
+		t.Fatalf("unexpected notification channels %+v", ncs)
+	}
+
+	updated := ncs[0]
+	updated.Settings = map[string]interface{}{"addresses": "oncall@example.com"}
+	if err = c.UpdateNotificationChannel(updated); err != nil {
+		t.Fatal(err)
+	}
+	if ncs, err = c.SearchNotificationChannel(); err != nil {
+		t.Fatal(err)
+	}
+	if ncs[0].Settings["addresses"] != "oncall@example.com" {
+		t.Fatalf("notification channel not updated: %+v", ncs[0])
+	}
+
+	if err = c.DeleteNotificationChannel(updated.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteNotificationChannel(updated.Id); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestContactPointRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// the provisioning api answers creations, updates and deletions with 202 Accepted
+	contactPoint := grafana.ContactPoint{Uid: "team", Name: "team", Type: "email", Settings: map[string]interface{}{"addresses": "team@example.com"}}
+	if err := c.CreateContactPoint(contactPoint); err != nil {
+		t.Fatal(err)
+	}
+	contactPoint.Settings = map[string]interface{}{"addresses": "oncall@example.com"}
+	if err := c.UpdateContactPoint(contactPoint); err != nil {
+		t.Fatal(err)
+	}
+	contactPoints, err := c.SearchContactPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contactPoints) != 1 || contactPoints[0].Settings["addresses"] != "oncall@example.com" {
+		t.Fatalf("unexpected contact points %+v", contactPoints)
+	}
+
+	if err = c.DeleteContactPoint("team"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteContactPoint("team"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if n := len(s.Requests()); n != 5 {
+		t.Fatalf("expected no request to be retried, got %d requests", n)
+	}
+}
+
+func TestPolicyTreeRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// the policy tree is replaced with 202 Accepted
+	tree := grafana.Route{
+		Receiver: "team",
+		GroupBy:  []string{"alertname"},
+		Routes:   []grafana.Route{{Receiver: "oncall", ObjectMatchers: [][]string{{"severity", "=", "critical"}}}},
+	}
+	if err := c.UpdatePolicyTree(tree); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetPolicyTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Receiver != "team" || len(got.Routes) != 1 || got.Routes[0].Receiver != "oncall" || got.Provenance != "api" {
+		t.Fatalf("unexpected policy tree %+v", got)
+	}
+
+	// a tree without a default receiver is refused
+	err = c.UpdatePolicyTree(grafana.Route{})
+	if apiErr, ok := err.(*grafana.APIError); !ok || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+func TestMuteTimingRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// mute timings are created with 201 Created, updated with 202 Accepted and deleted with 204 No Content
+	muteTiming := grafana.MuteTiming{Name: "weekends", TimeIntervals: []map[string]interface{}{{"weekdays": []interface{}{"saturday"}}}}
+	if err := c.CreateMuteTiming(muteTiming); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateMuteTiming(muteTiming); !grafana.IsConflict(err) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	muteTiming.TimeIntervals = []map[string]interface{}{{"weekdays": []interface{}{"saturday", "sunday"}}}
+	if err := c.UpdateMuteTiming(muteTiming); err != nil {
+		t.Fatal(err)
+	}
+	muteTimings, err := c.SearchMuteTimings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(muteTimings) != 1 || len(muteTimings[0].TimeIntervals[0]["weekdays"].([]interface{})) != 2 {
+		t.Fatalf("unexpected mute timings %+v", muteTimings)
+	}
+
+	if err = c.DeleteMuteTiming("weekends"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteMuteTiming("weekends"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestNotificationTemplateRoundTrip(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// templates are created and updated with 202 Accepted and deleted with 204 No Content
+	template := grafana.NotificationTemplate{Name: "alerts", Template: `{{ define "alerts" }}firing{{ end }}`}
+	if err := c.UpdateNotificationTemplate(template); err != nil {
+		t.Fatal(err)
+	}
+	template.Template = `{{ define "alerts" }}resolved{{ end }}`
+	if err := c.UpdateNotificationTemplate(template); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := c.SearchNotificationTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 1 || templates[0].Template != template.Template {
+		t.Fatalf("unexpected notification templates %+v", templates)
+	}
+
+	if err = c.DeleteNotificationTemplate("alerts"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteNotificationTemplate("alerts"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestFailedRequestsAreRetried(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	s.FailRequests(2, http.StatusServiceUnavailable)
+	if _, err := c.SearchDashboard(); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if n := len(s.Requests()); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	s.FailRequests(3, http.StatusServiceUnavailable)
+	_, err := c.SearchDashboard()
+	if grafana.StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after the last attempt, got %v", err)
+	}
+}
+
+func TestFailedRequestsAreNotRetried(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// a plain 500 of a create may be deterministic, it is not sent again
+	s.FailRequests(1, http.StatusInternalServerError)
+	err := c.CreateDatasource(grafana.Datasource{Name: "prometheus", Type: "prometheus"})
+	if grafana.StatusCode(err) != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %v", err)
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+
+	s.FailRequests(1, http.StatusBadRequest)
+	if _, err = c.SearchDashboard(); grafana.StatusCode(err) != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", err)
+	}
+	if n := len(s.Requests()); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	s.Token = "secret"
+
+	c.Auth = &grafana.TokenAuth{Token: "secret"}
+	if _, err := c.SearchDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if header := s.Requests()[0].Header.Get("Authorization"); header != "Bearer secret" {
+		t.Fatalf("unexpected authorization header %q", header)
+	}
+
+	c.Auth = &grafana.TokenAuth{Token: "wrong"}
+	if _, err := c.SearchDashboard(); !grafana.IsUnauthorized(err) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	c.Auth = nil
+	if _, err := c.SearchDashboard(); !grafana.IsUnauthorized(err) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	s.User, s.Password = "admin", "secret"
+
+	c.Auth = &grafana.BasicAuth{User: "admin", Password: "secret"}
+	if _, err := c.SearchDatasource(); err != nil {
+		t.Fatal(err)
+	}
+	c.Auth = &grafana.BasicAuth{User: "admin", Password: "wrong"}
+	if _, err := c.SearchDatasource(); !grafana.IsUnauthorized(err) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	c.Auth = &grafana.TokenAuth{Token: "secret"}
+	if _, err := c.SearchDatasource(); !grafana.IsUnauthorized(err) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	org, err := c.CreateOrg(grafana.Org{Name: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgs, err := c.SearchOrgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 || orgs[1].Name != "team" || orgs[1].Id != org.Id {
+		t.Fatalf("expected the default organization and team, got %+v", orgs)
+	}
+	found, err := c.GetOrgByName("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != org.Id {
+		t.Fatalf("expected org %d, got %d", org.Id, found.Id)
+	}
+	if _, err = c.GetOrgByName("other"); !grafana.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// objects are kept per organization
+	ctx := grafana.WithOrgId(context.Background(), org.Id)
+	if err = c.CreateDatasourceContext(ctx, grafana.Datasource{Name: "prometheus", Type: "prometheus"}); err != nil {
+		t.Fatal(err)
+	}
+	if dss, err := c.SearchDatasource(); err != nil || len(dss) != 0 {
+		t.Fatalf("expected no datasource in the default organization, got %+v, %v", dss, err)
+	}
+	if dss, err := c.SearchDatasourceContext(ctx); err != nil || len(dss) != 1 {
+		t.Fatalf("expected the datasource in organization %d, got %+v, %v", org.Id, dss, err)
+	}
+	if header := s.Requests()[len(s.Requests())-1].Header.Get("X-Grafana-Org-Id"); header == "" {
+		t.Fatal("expected the organization header")
+	}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	// grafana 8 has unified alerting, but its provisioning api only came with 9.0
+	reported := grafana.NewCapabilities("8.5.2")
+	reported.UnifiedAlerting, reported.LegacyAlerting = true, false
+	s.Grafana.SetCapabilities(reported)
+	caps, err := c.DetectCapabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Major != 8 || caps.Minor != 5 || !caps.UnifiedAlerting || caps.LegacyAlerting || caps.ProvisioningAPI || !caps.LibraryPanels {
+		t.Fatalf("unexpected capabilities of 8.5.2: %+v", caps)
+	}
+
+	s.Grafana.SetCapabilities(grafana.NewCapabilities("9.0.0"))
+	if caps, err = c.DetectCapabilities(); err != nil {
+		t.Fatal(err)
+	}
+	if !caps.UnifiedAlerting || !caps.ProvisioningAPI || caps.LegacyAlerting {
+		t.Fatalf("unexpected capabilities of 9.0.0: %+v", caps)
+	}
+	if c.Capabilities() != caps {
+		t.Fatal("detected capabilities are not kept")
+	}
+}
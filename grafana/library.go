@@ -0,0 +1,94 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// LibraryPanelKind is the kind of library elements which are panels
+const LibraryPanelKind = 1
+
+// LibraryElement is a panel shared by dashboards, which refer to it by its uid
+type LibraryElement struct {
+	Id          int                    `json:"id,omitempty"`
+	OrgId       int                    `json:"orgId,omitempty"`
+	Uid         string                 `json:"uid,omitempty"`
+	FolderId    int                    `json:"folderId"`
+	FolderUid   string                 `json:"folderUid,omitempty"`
+	Name        string                 `json:"name"`
+	Kind        int                    `json:"kind"`
+	Type        string                 `json:"type,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Model       map[string]interface{} `json:"model"`
+	Version     int                    `json:"version,omitempty"`
+}
+
+// the page size used to search library elements
+const libraryElementsPerPage = 100
+
+// return all library panels of the organization
+func (c *APIClient) SearchLibraryPanels() ([]LibraryElement, error) {
+	return c.SearchLibraryPanelsContext(context.Background())
+}
+
+func (c *APIClient) SearchLibraryPanelsContext(ctx context.Context) ([]LibraryElement, error) {
+	elements := make([]LibraryElement, 0)
+	for page := 1; ; page++ {
+		var result struct {
+			Result struct {
+				TotalCount int              `json:"totalCount"`
+				Elements   []LibraryElement `json:"elements"`
+			} `json:"result"`
+		}
+		query := "?kind=" + strconv.Itoa(LibraryPanelKind) + "&perPage=" + strconv.Itoa(libraryElementsPerPage) + "&page=" + strconv.Itoa(page)
+		if err := c.doGet(ctx, makeUrl(c.BaseUrl, "/api/library-elements")+query, &result); err != nil {
+			return nil, err
+		}
+		elements = append(elements, result.Result.Elements...)
+		if len(result.Result.Elements) < libraryElementsPerPage || len(elements) >= result.Result.TotalCount {
+			return elements, nil
+		}
+	}
+}
+
+func (c *APIClient) CreateLibraryElement(element LibraryElement) error {
+	return c.CreateLibraryElementContext(context.Background(), element)
+}
+
+func (c *APIClient) CreateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	return c.doPost(ctx, makeUrl(c.BaseUrl, "/api/library-elements"), element, nil)
+}
+
+// update a library element, its version has to be the version of the existing element
+func (c *APIClient) UpdateLibraryElement(element LibraryElement) error {
+	return c.UpdateLibraryElementContext(context.Background(), element)
+}
+
+func (c *APIClient) UpdateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	return c.doPatch(ctx, makeUrl(c.BaseUrl, "/api/library-elements/"+element.Uid), element, nil)
+}
+
+// delete a library element, grafana refuses to delete elements which are used by dashboards
+func (c *APIClient) DeleteLibraryElement(uid string) error {
+	return c.DeleteLibraryElementContext(context.Background(), uid)
+}
+
+func (c *APIClient) DeleteLibraryElementContext(ctx context.Context, uid string) error {
+	return c.doDelete(ctx, makeUrl(c.BaseUrl, "/api/library-elements/"+uid))
+}
+
+func (c *APIClient) doPatch(ctx context.Context, url string, data interface{}, result interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(dataJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	return c.doRequest(ctx, req, result)
+}
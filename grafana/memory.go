@@ -0,0 +1,961 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryClient is a Client keeping the state of a grafana in memory, separated by organization,
+// and recording every call, so code using a Client can be tested without grafana
+type MemoryClient struct {
+	// Errors makes the method with the given name, e.g. "CreateDashboard", return the error instead of being executed
+	Errors map[string]error
+
+	mtx      sync.Mutex
+	calls    []Call
+	orgs     map[int]*memoryOrg
+	orgNames map[string]int
+	users    []User
+	nextId   int
+	// reported are the capabilities returned by DetectCapabilities, detected the ones returned by Capabilities
+	reported *Capabilities
+	detected *Capabilities
+}
+
+// Call is a recorded call of a MemoryClient
+type Call struct {
+	// Method is the name of the method without the Context suffix, e.g. "CreateDashboard"
+	Method string
+	OrgId  int
+	Args   []interface{}
+}
+
+type memoryOrg struct {
+	dashboards           map[string]*Dashboard
+	datasources          []Datasource
+	notificationChannels []NotificationChannel
+	folders              []Folder
+	alertRules           []AlertRule
+	// ruleGroupIntervals holds the interval of each alert rule group by folder uid and title
+	ruleGroupIntervals map[string]int64
+	contactPoints      []ContactPoint
+	policyTree         Route
+	muteTimings        []MuteTiming
+	templates          []NotificationTemplate
+	libraryElements    []LibraryElement
+}
+
+// return a new MemoryClient with the default organization 1
+func NewMemoryClient() *MemoryClient {
+	m := &MemoryClient{
+		Errors:   make(map[string]error),
+		orgs:     make(map[int]*memoryOrg),
+		orgNames: make(map[string]int),
+		nextId:   1,
+		reported: NewCapabilities("6.1.4"),
+	}
+	m.addOrg("Main Org.")
+	return m
+}
+
+// return all recorded calls
+func (m *MemoryClient) Calls() []Call {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	calls := make([]Call, len(m.calls))
+	copy(calls, m.calls)
+	return calls
+}
+
+// return the method names of all recorded calls
+func (m *MemoryClient) CallNames() []string {
+	names := make([]string, 0)
+	for _, call := range m.Calls() {
+		names = append(names, call.Method)
+	}
+	return names
+}
+
+// forget all recorded calls but keep the state
+func (m *MemoryClient) ResetCalls() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.calls = nil
+}
+
+func (m *MemoryClient) SearchDashboardContext(ctx context.Context) ([]SearchHit, error) {
+	org, err := m.record(ctx, "SearchDashboard")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]SearchHit, 0)
+	for _, fd := range org.folders {
+		hits = append(hits, SearchHit{Id: fd.Id, Uid: fd.Uid, Title: fd.Title, Uri: "db/" + slugify(fd.Title), Url: fd.Url, Type: "dash-folder"})
+	}
+	for _, dh := range org.dashboards {
+		hit := SearchHit{Id: dh.id(), Uid: dh.Uid(), Title: dh.Title(), Uri: "db/" + slugify(dh.Title()), Url: dh.Meta.Url, Type: "dash-db", Tags: dh.Tags(), FolderId: dh.FolderId}
+		if fd := org.folderById(dh.FolderId); fd != nil {
+			hit.FolderUid = fd.Uid
+			hit.FolderTitle = fd.Title
+			hit.FolderUrl = fd.Url
+		}
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Id < hits[j].Id })
+	return hits, nil
+}
+
+func (m *MemoryClient) GetDashboardContext(ctx context.Context, uid string) (*Dashboard, error) {
+	org, err := m.record(ctx, "GetDashboard", uid)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	dh, ok := org.dashboards[uid]
+	if !ok {
+		return nil, notFound("GET", "/api/dashboards/uid/"+uid, "Dashboard not found")
+	}
+	result := dh.copy()
+	return &result, nil
+}
+
+func (m *MemoryClient) CreateDashboardContext(ctx context.Context, dashboard Dashboard) (*DashboardSaveResult, error) {
+	org, err := m.record(ctx, "CreateDashboard", dashboard)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := "/api/dashboards/db"
+	dh := dashboard.copy()
+	if dh.FolderId != 0 && org.folderById(dh.FolderId) == nil {
+		return nil, &APIError{StatusCode: http.StatusBadRequest, Message: "Folder not found", Method: "POST", Endpoint: endpoint}
+	}
+	if dh.Uid() == "" {
+		dh.SetUid(m.newUid())
+	}
+	existing, exists := org.dashboards[dh.Uid()]
+	for uid, other := range org.dashboards {
+		if uid != dh.Uid() && other.FolderId == dh.FolderId && strings.EqualFold(other.Title(), dh.Title()) {
+			if !dh.Overwrite {
+				return nil, &APIError{StatusCode: http.StatusPreconditionFailed, Status: "name-exists", Message: "A dashboard with the same name in the folder already exists", Method: "POST", Endpoint: endpoint}
+			}
+			delete(org.dashboards, uid)
+		}
+	}
+	id, version := m.newId(), 1
+	if exists {
+		if !dh.Overwrite && dh.Version() != existing.Version() {
+			return nil, &APIError{StatusCode: http.StatusPreconditionFailed, Status: "version-mismatch", Message: "The dashboard has been changed by someone else", Method: "POST", Endpoint: endpoint}
+		}
+		id, version = existing.id(), existing.Version()+1
+	}
+	dh.Model["id"] = float64(id)
+	dh.Model["version"] = float64(version)
+	dh.Overwrite = false
+	dh.Message = ""
+	dh.Meta = &DashboardMeta{Type: "db", CanSave: true, CanEdit: true, Slug: slugify(dh.Title()), Url: "/d/" + dh.Uid() + "/" + slugify(dh.Title()), Version: version, FolderId: dh.FolderId}
+	if fd := org.folderById(dh.FolderId); fd != nil {
+		dh.FolderUid = fd.Uid
+		dh.Meta.FolderUid = fd.Uid
+		dh.Meta.FolderTitle = fd.Title
+		dh.Meta.FolderUrl = fd.Url
+	}
+	org.dashboards[dh.Uid()] = &dh
+	return &DashboardSaveResult{Id: id, Uid: dh.Uid(), Url: dh.Meta.Url, Slug: dh.Meta.Slug, Status: "success", Version: version}, nil
+}
+
+func (m *MemoryClient) DeleteDashboardContext(ctx context.Context, uid string) error {
+	org, err := m.record(ctx, "DeleteDashboard", uid)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, ok := org.dashboards[uid]; !ok {
+		return notFound("DELETE", "/api/dashboards/uid/"+uid, "Dashboard not found")
+	}
+	delete(org.dashboards, uid)
+	return nil
+}
+
+func (m *MemoryClient) SearchDatasourceContext(ctx context.Context) ([]Datasource, error) {
+	org, err := m.record(ctx, "SearchDatasource")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Datasource{}, org.datasources...), nil
+}
+
+func (m *MemoryClient) CreateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	org, err := m.record(ctx, "CreateDatasource", datasource)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, ds := range org.datasources {
+		if ds.Name == datasource.Name {
+			return &APIError{StatusCode: http.StatusConflict, Message: "Data source with same name already exists", Method: "POST", Endpoint: "/api/datasources"}
+		}
+	}
+	datasource.Id = m.newId()
+	if datasource.Uid == "" {
+		datasource.Uid = m.newUid()
+	}
+	datasource.OrgId = orgId(ctx)
+	datasource.Version = 1
+	org.datasources = append(org.datasources, datasource)
+	return nil
+}
+
+func (m *MemoryClient) UpdateDatasourceContext(ctx context.Context, datasource Datasource) error {
+	org, err := m.record(ctx, "UpdateDatasource", datasource)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, ds := range org.datasources {
+		if ds.Id == datasource.Id {
+			if datasource.Uid == "" {
+				datasource.Uid = ds.Uid
+			}
+			datasource.OrgId = ds.OrgId
+			datasource.Version = ds.Version + 1
+			org.datasources[i] = datasource
+			return nil
+		}
+	}
+	return notFound("PUT", "/api/datasources/"+strconv.Itoa(datasource.Id), "Data source not found")
+}
+
+func (m *MemoryClient) DeleteDatasourceContext(ctx context.Context, name string) error {
+	org, err := m.record(ctx, "DeleteDatasource", name)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, ds := range org.datasources {
+		if ds.Name == name {
+			org.datasources = append(org.datasources[:i], org.datasources[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/datasources/name/"+name, "Data source not found")
+}
+
+func (m *MemoryClient) SearchNotificationChannelContext(ctx context.Context) ([]NotificationChannel, error) {
+	org, err := m.record(ctx, "SearchNotificationChannel")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return append([]NotificationChannel{}, org.notificationChannels...), nil
+}
+
+func (m *MemoryClient) CreateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	org, err := m.record(ctx, "CreateNotificationChannel", notificationChannel)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, nc := range org.notificationChannels {
+		if nc.Name == notificationChannel.Name || (notificationChannel.Uid != "" && nc.Uid == notificationChannel.Uid) {
+			return &APIError{StatusCode: http.StatusConflict, Message: "Alert notification or its uid already exists", Method: "POST", Endpoint: "/api/alert-notifications"}
+		}
+	}
+	notificationChannel.Id = m.newId()
+	if notificationChannel.Uid == "" {
+		notificationChannel.Uid = m.newUid()
+	}
+	org.notificationChannels = append(org.notificationChannels, notificationChannel)
+	return nil
+}
+
+func (m *MemoryClient) UpdateNotificationChannelContext(ctx context.Context, notificationChannel NotificationChannel) error {
+	org, err := m.record(ctx, "UpdateNotificationChannel", notificationChannel)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, nc := range org.notificationChannels {
+		if nc.Id == notificationChannel.Id {
+			if notificationChannel.Uid == "" {
+				notificationChannel.Uid = nc.Uid
+			}
+			org.notificationChannels[i] = notificationChannel
+			return nil
+		}
+	}
+	return notFound("PUT", "/api/alert-notifications/"+strconv.Itoa(notificationChannel.Id), "Alert notification not found")
+}
+
+func (m *MemoryClient) DeleteNotificationChannelContext(ctx context.Context, id int) error {
+	org, err := m.record(ctx, "DeleteNotificationChannel", id)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, nc := range org.notificationChannels {
+		if nc.Id == id {
+			org.notificationChannels = append(org.notificationChannels[:i], org.notificationChannels[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/alert-notifications/"+strconv.Itoa(id), "Alert notification not found")
+}
+
+func (m *MemoryClient) SearchFolderContext(ctx context.Context) ([]Folder, error) {
+	org, err := m.record(ctx, "SearchFolder")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Folder{}, org.folders...), nil
+}
+
+func (m *MemoryClient) CreateFolderContext(ctx context.Context, folder Folder) (*Folder, error) {
+	org, err := m.record(ctx, "CreateFolder", folder)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range org.folders {
+		if strings.EqualFold(fd.Title, folder.Title) || (folder.Uid != "" && fd.Uid == folder.Uid) {
+			return nil, &APIError{StatusCode: http.StatusConflict, Message: "A folder or dashboard in the general folder with the same name already exists", Method: "POST", Endpoint: "/api/folders"}
+		}
+	}
+	folder.Id = m.newId()
+	if folder.Uid == "" {
+		folder.Uid = m.newUid()
+	}
+	folder.Url = "/dashboards/f/" + folder.Uid + "/" + slugify(folder.Title)
+	folder.Version = 1
+	org.folders = append(org.folders, folder)
+	return &folder, nil
+}
+
+func (m *MemoryClient) CreateUserContext(ctx context.Context, user User) error {
+	_, err := m.record(ctx, "CreateUser", user)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, u := range m.users {
+		if u.Login == user.Login || (user.Email != "" && u.Email == user.Email) {
+			return &APIError{StatusCode: http.StatusPreconditionFailed, Message: "User with same email or username already exists", Method: "POST", Endpoint: "/api/admin/users"}
+		}
+	}
+	m.users = append(m.users, user)
+	return nil
+}
+
+func (m *MemoryClient) SearchOrgsContext(ctx context.Context) ([]Org, error) {
+	_, err := m.record(ctx, "SearchOrgs")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	orgs := make([]Org, 0, len(m.orgNames))
+	for name, id := range m.orgNames {
+		orgs = append(orgs, Org{Id: id, Name: name})
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Id < orgs[j].Id })
+	return orgs, nil
+}
+
+func (m *MemoryClient) GetOrgByNameContext(ctx context.Context, name string) (*Org, error) {
+	_, err := m.record(ctx, "GetOrgByName", name)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	id, ok := m.orgNames[name]
+	if !ok {
+		return nil, notFound("GET", "/api/orgs/name/"+name, "Organization not found")
+	}
+	return &Org{Id: id, Name: name}, nil
+}
+
+func (m *MemoryClient) CreateOrgContext(ctx context.Context, org Org) (*Org, error) {
+	_, err := m.record(ctx, "CreateOrg", org)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := m.orgNames[org.Name]; ok {
+		return nil, &APIError{StatusCode: http.StatusConflict, Message: "Organization name taken", Method: "POST", Endpoint: "/api/orgs"}
+	}
+	return &Org{Id: m.addOrg(org.Name), Name: org.Name}, nil
+}
+
+func (m *MemoryClient) SearchAlertRulesContext(ctx context.Context) ([]AlertRule, error) {
+	org, err := m.record(ctx, "SearchAlertRules")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]AlertRule, 0, len(org.alertRules))
+	for _, rule := range org.alertRules {
+		rules = append(rules, rule.copy())
+	}
+	return rules, nil
+}
+
+func (m *MemoryClient) GetAlertRuleGroupContext(ctx context.Context, folderUid string, title string) (*AlertRuleGroup, error) {
+	org, err := m.record(ctx, "GetAlertRuleGroup", folderUid, title)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	group := &AlertRuleGroup{Title: title, FolderUid: folderUid, Interval: org.ruleGroupIntervals[folderUid+"/"+title], Rules: []AlertRule{}}
+	for _, rule := range org.alertRules {
+		if rule.FolderUid == folderUid && rule.RuleGroup == title {
+			group.Rules = append(group.Rules, rule.copy())
+		}
+	}
+	if len(group.Rules) == 0 {
+		return nil, notFound("GET", "/api/v1/provisioning/folder/"+folderUid+"/rule-groups/"+title, "rule group does not exist")
+	}
+	return group, nil
+}
+
+func (m *MemoryClient) UpdateAlertRuleGroupContext(ctx context.Context, group AlertRuleGroup) (*AlertRuleGroup, error) {
+	org, err := m.record(ctx, "UpdateAlertRuleGroup", group)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := "/api/v1/provisioning/folder/" + group.FolderUid + "/rule-groups/" + group.Title
+	found := false
+	for _, fd := range org.folders {
+		found = found || fd.Uid == group.FolderUid
+	}
+	if !found {
+		return nil, &APIError{StatusCode: http.StatusBadRequest, Message: "folder does not exist", Method: "PUT", Endpoint: endpoint}
+	}
+	ids := make(map[string]int)
+	for _, rule := range org.alertRules {
+		ids[rule.Uid] = rule.Id
+	}
+	saved := make(map[string]bool)
+	result := &AlertRuleGroup{Title: group.Title, FolderUid: group.FolderUid, Interval: group.Interval}
+	for _, rule := range group.Rules {
+		rule = rule.copy()
+		if rule.Uid == "" {
+			rule.Uid = m.newUid()
+		}
+		if saved[rule.Uid] {
+			return nil, &APIError{StatusCode: http.StatusBadRequest, Message: "rule uid is not unique in the group: " + rule.Uid, Method: "PUT", Endpoint: endpoint}
+		}
+		if rule.Id = ids[rule.Uid]; rule.Id == 0 {
+			rule.Id = m.newId()
+		}
+		rule.OrgId = orgId(ctx)
+		rule.FolderUid = group.FolderUid
+		rule.RuleGroup = group.Title
+		rule.Provenance = "api"
+		saved[rule.Uid] = true
+		result.Rules = append(result.Rules, rule)
+	}
+	// the rules of the group which are not given anymore are deleted, given rules of other groups are moved
+	rules := make([]AlertRule, 0, len(org.alertRules)+len(result.Rules))
+	for _, rule := range org.alertRules {
+		if !saved[rule.Uid] && (rule.FolderUid != group.FolderUid || rule.RuleGroup != group.Title) {
+			rules = append(rules, rule)
+		}
+	}
+	for _, rule := range result.Rules {
+		rules = append(rules, rule.copy())
+	}
+	org.alertRules = rules
+	org.ruleGroupIntervals[group.FolderUid+"/"+group.Title] = group.Interval
+	return result, nil
+}
+
+func (m *MemoryClient) DeleteAlertRuleContext(ctx context.Context, uid string) error {
+	org, err := m.record(ctx, "DeleteAlertRule", uid)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, rule := range org.alertRules {
+		if rule.Uid == uid {
+			org.alertRules = append(org.alertRules[:i], org.alertRules[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/v1/provisioning/alert-rules/"+uid, "rule not found")
+}
+
+func (m *MemoryClient) SearchContactPointsContext(ctx context.Context) ([]ContactPoint, error) {
+	org, err := m.record(ctx, "SearchContactPoints")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	contactPoints := make([]ContactPoint, 0, len(org.contactPoints))
+	for _, contactPoint := range org.contactPoints {
+		contactPoints = append(contactPoints, contactPoint.copy())
+	}
+	return contactPoints, nil
+}
+
+func (m *MemoryClient) CreateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	org, err := m.record(ctx, "CreateContactPoint", contactPoint)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if contactPoint.Uid == "" {
+		contactPoint.Uid = m.newUid()
+	}
+	for _, existing := range org.contactPoints {
+		if existing.Uid == contactPoint.Uid {
+			return &APIError{StatusCode: http.StatusConflict, Message: "contact point with the same uid already exists", Method: "POST", Endpoint: "/api/v1/provisioning/contact-points"}
+		}
+	}
+	contactPoint = contactPoint.copy()
+	contactPoint.Provenance = "api"
+	org.contactPoints = append(org.contactPoints, contactPoint)
+	return nil
+}
+
+func (m *MemoryClient) UpdateContactPointContext(ctx context.Context, contactPoint ContactPoint) error {
+	org, err := m.record(ctx, "UpdateContactPoint", contactPoint)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, existing := range org.contactPoints {
+		if existing.Uid == contactPoint.Uid {
+			contactPoint = contactPoint.copy()
+			contactPoint.Provenance = "api"
+			org.contactPoints[i] = contactPoint
+			return nil
+		}
+	}
+	return notFound("PUT", "/api/v1/provisioning/contact-points/"+contactPoint.Uid, "contact point not found")
+}
+
+func (m *MemoryClient) DeleteContactPointContext(ctx context.Context, uid string) error {
+	org, err := m.record(ctx, "DeleteContactPoint", uid)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, contactPoint := range org.contactPoints {
+		if contactPoint.Uid == uid {
+			org.contactPoints = append(org.contactPoints[:i], org.contactPoints[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/v1/provisioning/contact-points/"+uid, "contact point not found")
+}
+
+func (m *MemoryClient) GetPolicyTreeContext(ctx context.Context) (*Route, error) {
+	org, err := m.record(ctx, "GetPolicyTree")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tree := org.policyTree.copy()
+	return &tree, nil
+}
+
+func (m *MemoryClient) UpdatePolicyTreeContext(ctx context.Context, tree Route) error {
+	org, err := m.record(ctx, "UpdatePolicyTree", tree)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if tree.Receiver == "" || len(tree.ObjectMatchers) > 0 || len(tree.Matchers) > 0 {
+		return &APIError{StatusCode: http.StatusBadRequest, Message: "invalid object specification: root route must specify a default receiver and no matchers", Method: "PUT", Endpoint: "/api/v1/provisioning/policies"}
+	}
+	tree = tree.copy()
+	tree.Provenance = "api"
+	org.policyTree = tree
+	return nil
+}
+
+func (m *MemoryClient) SearchMuteTimingsContext(ctx context.Context) ([]MuteTiming, error) {
+	org, err := m.record(ctx, "SearchMuteTimings")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	muteTimings := make([]MuteTiming, 0, len(org.muteTimings))
+	for _, muteTiming := range org.muteTimings {
+		muteTimings = append(muteTimings, muteTiming.copy())
+	}
+	return muteTimings, nil
+}
+
+func (m *MemoryClient) CreateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	org, err := m.record(ctx, "CreateMuteTiming", muteTiming)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, existing := range org.muteTimings {
+		if existing.Name == muteTiming.Name {
+			return &APIError{StatusCode: http.StatusConflict, Message: "a mute timing with this name already exists", Method: "POST", Endpoint: "/api/v1/provisioning/mute-timings"}
+		}
+	}
+	muteTiming = muteTiming.copy()
+	muteTiming.Provenance = "api"
+	org.muteTimings = append(org.muteTimings, muteTiming)
+	return nil
+}
+
+func (m *MemoryClient) UpdateMuteTimingContext(ctx context.Context, muteTiming MuteTiming) error {
+	org, err := m.record(ctx, "UpdateMuteTiming", muteTiming)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, existing := range org.muteTimings {
+		if existing.Name == muteTiming.Name {
+			muteTiming = muteTiming.copy()
+			muteTiming.Provenance = "api"
+			org.muteTimings[i] = muteTiming
+			return nil
+		}
+	}
+	return notFound("PUT", "/api/v1/provisioning/mute-timings/"+muteTiming.Name, "mute timing not found")
+}
+
+func (m *MemoryClient) DeleteMuteTimingContext(ctx context.Context, name string) error {
+	org, err := m.record(ctx, "DeleteMuteTiming", name)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, muteTiming := range org.muteTimings {
+		if muteTiming.Name == name {
+			org.muteTimings = append(org.muteTimings[:i], org.muteTimings[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/v1/provisioning/mute-timings/"+name, "mute timing not found")
+}
+
+func (m *MemoryClient) SearchNotificationTemplatesContext(ctx context.Context) ([]NotificationTemplate, error) {
+	org, err := m.record(ctx, "SearchNotificationTemplates")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]NotificationTemplate, len(org.templates))
+	copy(templates, org.templates)
+	return templates, nil
+}
+
+func (m *MemoryClient) UpdateNotificationTemplateContext(ctx context.Context, template NotificationTemplate) error {
+	org, err := m.record(ctx, "UpdateNotificationTemplate", template)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	template.Provenance = "api"
+	for i, existing := range org.templates {
+		if existing.Name == template.Name {
+			org.templates[i] = template
+			return nil
+		}
+	}
+	org.templates = append(org.templates, template)
+	return nil
+}
+
+func (m *MemoryClient) DeleteNotificationTemplateContext(ctx context.Context, name string) error {
+	org, err := m.record(ctx, "DeleteNotificationTemplate", name)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, template := range org.templates {
+		if template.Name == name {
+			org.templates = append(org.templates[:i], org.templates[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("DELETE", "/api/v1/provisioning/templates/"+name, "template not found")
+}
+
+func (m *MemoryClient) SearchLibraryPanelsContext(ctx context.Context) ([]LibraryElement, error) {
+	org, err := m.record(ctx, "SearchLibraryPanels")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	elements := make([]LibraryElement, 0, len(org.libraryElements))
+	for _, element := range org.libraryElements {
+		if element.Kind == LibraryPanelKind {
+			elements = append(elements, element.copy())
+		}
+	}
+	return elements, nil
+}
+
+func (m *MemoryClient) CreateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	org, err := m.record(ctx, "CreateLibraryElement", element)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	endpoint := "/api/library-elements"
+	element = element.copy()
+	if err = org.resolveFolder(&element, "POST", endpoint); err != nil {
+		return err
+	}
+	for _, existing := range org.libraryElements {
+		if existing.Uid == element.Uid || (existing.FolderId == element.FolderId && existing.Name == element.Name) {
+			return &APIError{StatusCode: http.StatusBadRequest, Message: "library element with that name or UID already exists", Method: "POST", Endpoint: endpoint}
+		}
+	}
+	element.Id = m.newId()
+	if element.Uid == "" {
+		element.Uid = m.newUid()
+	}
+	element.OrgId = orgId(ctx)
+	element.Type, _ = element.Model["type"].(string)
+	element.Description, _ = element.Model["description"].(string)
+	element.Version = 1
+	org.libraryElements = append(org.libraryElements, element)
+	return nil
+}
+
+func (m *MemoryClient) UpdateLibraryElementContext(ctx context.Context, element LibraryElement) error {
+	org, err := m.record(ctx, "UpdateLibraryElement", element)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	endpoint := "/api/library-elements/" + element.Uid
+	element = element.copy()
+	if err = org.resolveFolder(&element, "PATCH", endpoint); err != nil {
+		return err
+	}
+	for i, existing := range org.libraryElements {
+		if existing.Uid != element.Uid {
+			continue
+		}
+		if existing.Version != element.Version {
+			return &APIError{StatusCode: http.StatusPreconditionFailed, Message: "the library element has been changed by someone else", Method: "PATCH", Endpoint: endpoint}
+		}
+		element.Id = existing.Id
+		element.OrgId = existing.OrgId
+		element.Type, _ = element.Model["type"].(string)
+		element.Description, _ = element.Model["description"].(string)
+		element.Version = existing.Version + 1
+		org.libraryElements[i] = element
+		return nil
+	}
+	return notFound("PATCH", endpoint, "library element could not be found")
+}
+
+func (m *MemoryClient) DeleteLibraryElementContext(ctx context.Context, uid string) error {
+	org, err := m.record(ctx, "DeleteLibraryElement", uid)
+	defer m.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	endpoint := "/api/library-elements/" + uid
+	for i, element := range org.libraryElements {
+		if element.Uid != uid {
+			continue
+		}
+		for _, dh := range org.dashboards {
+			for _, used := range dh.LibraryPanelUids() {
+				if used == uid {
+					return &APIError{StatusCode: http.StatusForbidden, Message: "the library element has connections", Method: "DELETE", Endpoint: endpoint}
+				}
+			}
+		}
+		org.libraryElements = append(org.libraryElements[:i], org.libraryElements[i+1:]...)
+		return nil
+	}
+	return notFound("DELETE", endpoint, "library element could not be found")
+}
+
+// set the capabilities DetectCapabilities reports
+func (m *MemoryClient) SetCapabilities(capabilities *Capabilities) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.reported = capabilities
+}
+
+func (m *MemoryClient) DetectCapabilitiesContext(ctx context.Context) (*Capabilities, error) {
+	_, err := m.record(ctx, "DetectCapabilities")
+	defer m.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	m.detected = m.reported
+	return m.detected, nil
+}
+
+func (m *MemoryClient) Capabilities() *Capabilities {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.detected
+}
+
+// lock the client, record the call and return the state of the organization of ctx or the configured error,
+// the caller has to unlock the client
+func (m *MemoryClient) record(ctx context.Context, method string, args ...interface{}) (*memoryOrg, error) {
+	m.mtx.Lock()
+	id := orgId(ctx)
+	m.calls = append(m.calls, Call{Method: method, OrgId: id, Args: args})
+	if err, ok := m.Errors[method]; ok && err != nil {
+		return nil, err
+	}
+	org, ok := m.orgs[id]
+	if !ok {
+		return nil, &APIError{StatusCode: http.StatusUnauthorized, Message: "User is not a member of organization " + strconv.Itoa(id)}
+	}
+	return org, nil
+}
+
+// add a new organization, the lock has to be held
+func (m *MemoryClient) addOrg(name string) int {
+	id := len(m.orgs) + 1
+	m.orgs[id] = &memoryOrg{dashboards: make(map[string]*Dashboard), ruleGroupIntervals: make(map[string]int64), policyTree: defaultPolicyTree()}
+	m.orgNames[name] = id
+	return id
+}
+
+// the lock has to be held
+func (m *MemoryClient) newId() int {
+	id := m.nextId
+	m.nextId++
+	return id
+}
+
+// the lock has to be held
+func (m *MemoryClient) newUid() string {
+	return "uid" + strconv.Itoa(m.newId())
+}
+
+// set the folder id and uid of a library element from either of them, the general folder has neither
+func (o *memoryOrg) resolveFolder(element *LibraryElement, method string, endpoint string) error {
+	var fd *Folder
+	for i := range o.folders {
+		if (element.FolderUid != "" && o.folders[i].Uid == element.FolderUid) || (element.FolderUid == "" && o.folders[i].Id == element.FolderId) {
+			fd = &o.folders[i]
+		}
+	}
+	if fd == nil && (element.FolderUid != "" || element.FolderId != 0) {
+		return &APIError{StatusCode: http.StatusBadRequest, Message: "folder not found", Method: method, Endpoint: endpoint}
+	}
+	element.FolderId, element.FolderUid = 0, ""
+	if fd != nil {
+		element.FolderId, element.FolderUid = fd.Id, fd.Uid
+	}
+	return nil
+}
+
+func (o *memoryOrg) folderById(id int) *Folder {
+	for i := range o.folders {
+		if o.folders[i].Id == id {
+			return &o.folders[i]
+		}
+	}
+	return nil
+}
+
+// return the organization of ctx, grafana uses the organization 1 by default
+func orgId(ctx context.Context) int {
+	if id, ok := OrgIdFromContext(ctx); ok {
+		return id
+	}
+	return 1
+}
+
+func notFound(method string, endpoint string, message string) *APIError {
+	return &APIError{StatusCode: http.StatusNotFound, Message: message, Method: method, Endpoint: endpoint}
+}
+
+// return a deep copy of the alert rule, so the caller and the state do not share its maps
+func (r AlertRule) copy() AlertRule {
+	var result AlertRule
+	if data, err := json.Marshal(r); err == nil && json.Unmarshal(data, &result) == nil {
+		return result
+	}
+	return r
+}
+
+// return the policy tree of a new grafana organization
+func defaultPolicyTree() Route {
+	return Route{Receiver: "grafana-default-email", GroupBy: []string{"grafana_folder", "alertname"}}
+}
+
+// return a deep copy of the route, so the caller and the state do not share its nested routes
+func (r Route) copy() Route {
+	var result Route
+	if data, err := json.Marshal(r); err == nil && json.Unmarshal(data, &result) == nil {
+		return result
+	}
+	return r
+}
+
+// return a deep copy of the mute timing, so the caller and the state do not share its time intervals
+func (t MuteTiming) copy() MuteTiming {
+	var result MuteTiming
+	if data, err := json.Marshal(t); err == nil && json.Unmarshal(data, &result) == nil {
+		return result
+	}
+	return t
+}
+
+// return a deep copy of the library element, so the caller and the state do not share its model
+func (e LibraryElement) copy() LibraryElement {
+	var result LibraryElement
+	if data, err := json.Marshal(e); err == nil && json.Unmarshal(data, &result) == nil {
+		return result
+	}
+	return e
+}
+
+// return a deep copy of the contact point, so the caller and the state do not share its settings
+func (p ContactPoint) copy() ContactPoint {
+	var result ContactPoint
+	if data, err := json.Marshal(p); err == nil && json.Unmarshal(data, &result) == nil {
+		return result
+	}
+	return p
+}
+
+// return a deep copy of the dashboard, so the caller and the state do not share the model
+func (d *Dashboard) copy() Dashboard {
+	result := *d
+	result.Model = make(map[string]interface{})
+	if data, err := json.Marshal(d.Model); err == nil {
+		json.Unmarshal(data, &result.Model)
+	}
+	if d.Meta != nil {
+		meta := *d.Meta
+		result.Meta = &meta
+	}
+	return result
+}
+
+func (d *Dashboard) id() int {
+	if v, ok := d.Model["id"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+var nonSlugChars = regexp.MustCompile("[^a-z0-9]+")
+
+// return the url slug grafana builds from a title
+func slugify(title string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
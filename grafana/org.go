@@ -0,0 +1,17 @@
+package grafana
+
+import "context"
+
+type orgIdKey struct{}
+
+// return a context which scopes all api calls made with it to the given organization,
+// the authenticated user has to be a member of it
+func WithOrgId(ctx context.Context, orgId int) context.Context {
+	return context.WithValue(ctx, orgIdKey{}, orgId)
+}
+
+// return the organization set by WithOrgId
+func OrgIdFromContext(ctx context.Context) (int, bool) {
+	orgId, ok := ctx.Value(orgIdKey{}).(int)
+	return orgId, ok
+}
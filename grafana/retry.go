@@ -0,0 +1,101 @@
+package grafana
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether a failed api request is sent again and how long to wait before
+type RetryPolicy interface {
+	// Retry is called after every failed attempt with either the response or the error of the attempt,
+	// attempt starts with 1
+	Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool)
+}
+
+// BackoffPolicy retries network errors, 429 and 5xx responses with exponential backoff and jitter
+// and honors the Retry-After header sent by grafana or a proxy in front of it
+type BackoffPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one, 0 means unlimited
+	MaxAttempts int
+	// InitialBackoff is the wait time after the first failed attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait time between two attempts
+	MaxBackoff time.Duration
+	// Multiplier is the factor the wait time grows with after every attempt
+	Multiplier float64
+	// Jitter is the fraction of the wait time which is randomized, between 0 and 1
+	Jitter float64
+}
+
+// return the default retry policy
+func DefaultRetryPolicy() *BackoffPolicy {
+	return &BackoffPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+func (p *BackoffPolicy) Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if err == nil && !retryableStatus(req.Method, resp.StatusCode) {
+		return 0, false
+	}
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait, true
+		}
+	}
+	return p.backoff(attempt), true
+}
+
+// return the wait time after the given attempt
+func (p *BackoffPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		wait = wait * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(wait)
+}
+
+// grafana answers many deterministic failures of a create with 500 (e.g. user already exists),
+// so a plain 500 is only retried for requests which can be repeated safely
+func retryableStatus(method string, statusCode int) bool {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return true
+	case statusCode == http.StatusInternalServerError:
+		return method != "POST"
+	case statusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// parse the Retry-After header which is either in seconds or a http date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,190 @@
+package grafana
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// TLSConfig holds the files and options used for the https connection to grafana
+type TLSConfig struct {
+	// CAFile is a pem bundle of CAs used to verify grafana, the system CAs are used if empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key presented to grafana for mTLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and to verify the certificate of grafana
+	ServerName string
+	// InsecureSkipVerify disables the verification of the certificate of grafana
+	InsecureSkipVerify bool
+}
+
+// is any tls option set
+func (t TLSConfig) isSet() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.InsecureSkipVerify
+}
+
+// configure the http client of the APIClient to use the given tls options,
+// the CA and client certificate files are loaded again whenever they change on disk
+func (c *APIClient) ConfigureTLS(config TLSConfig) error {
+	if !config.isSet() {
+		return nil
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return errors.New("client certificate and key have to be set both")
+	}
+
+	reloader := &tlsReloader{config: config, c: c}
+	if err := reloader.reload(); err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CertFile != "" {
+		tlsConfig.GetClientCertificate = reloader.getClientCertificate
+	}
+	if config.CAFile != "" && !config.InsecureSkipVerify {
+		// the go verification only knows a fixed root pool, so verify on our own against the reloaded pool
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = reloader.verifyPeerCertificate
+	}
+
+	c.HTTPClient.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return nil
+}
+
+// tlsReloader keeps the CA pool and client certificate up to date with the files on disk
+type tlsReloader struct {
+	config TLSConfig
+	c      *APIClient
+
+	mtx         sync.Mutex
+	caModTime   time.Time
+	certModTime time.Time
+	keyModTime  time.Time
+	caPool      *x509.CertPool
+	cert        *tls.Certificate
+}
+
+// load the files again if their modification time changed, keep the old state on errors
+func (r *tlsReloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.config.CAFile != "" {
+		caModTime, err := modTime(r.config.CAFile)
+		if err != nil {
+			return err
+		}
+		if !caModTime.Equal(r.caModTime) {
+			caPEM, err := ioutil.ReadFile(r.config.CAFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return errors.New("no certificate found in CA file " + r.config.CAFile)
+			}
+			r.caPool = pool
+			r.caModTime = caModTime
+			level.Info(r.c.logger).Log("msg", "Loaded CA file: "+r.config.CAFile)
+		}
+	}
+
+	if r.config.CertFile != "" {
+		certModTime, err := modTime(r.config.CertFile)
+		if err != nil {
+			return err
+		}
+		keyModTime, err := modTime(r.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		if !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime) {
+			cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+			if err != nil {
+				return err
+			}
+			r.cert = &cert
+			r.certModTime = certModTime
+			r.keyModTime = keyModTime
+			level.Info(r.c.logger).Log("msg", "Loaded client certificate: "+r.config.CertFile)
+		}
+	}
+	return nil
+}
+
+func (r *tlsReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		level.Error(r.c.logger).Log("msg", "Failed to reload client certificate, using the previous one", "err", err.Error())
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.cert, nil
+}
+
+func (r *tlsReloader) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if err := r.reload(); err != nil {
+		level.Error(r.c.logger).Log("msg", "Failed to reload CA file, using the previous one", "err", err.Error())
+	}
+	r.mtx.Lock()
+	pool := r.caPool
+	r.mtx.Unlock()
+
+	if len(rawCerts) == 0 {
+		return errors.New("grafana did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	serverName := r.config.ServerName
+	if serverName == "" {
+		serverName = r.c.BaseUrl.Hostname()
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+	return err
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,202 @@
+package grafana
+
+// SearchHit is a single entry returned by /api/search
+type SearchHit struct {
+	Id          int      `json:"id"`
+	Uid         string   `json:"uid"`
+	Title       string   `json:"title"`
+	Uri         string   `json:"uri"`
+	Url         string   `json:"url"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	IsStarred   bool     `json:"isStarred"`
+	FolderId    int      `json:"folderId"`
+	FolderUid   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+	FolderUrl   string   `json:"folderUrl"`
+}
+
+// Dashboard is the envelope grafana uses to save and return a dashboard,
+// the dashboard itself is kept as raw model since its schema is open
+type Dashboard struct {
+	Model     map[string]interface{} `json:"dashboard"`
+	FolderId  int                    `json:"folderId"`
+	FolderUid string                 `json:"folderUid,omitempty"`
+	Overwrite bool                   `json:"overwrite"`
+	Message   string                 `json:"message,omitempty"`
+	Meta      *DashboardMeta         `json:"meta,omitempty"`
+}
+
+// DashboardMeta is the metadata grafana returns together with a dashboard
+type DashboardMeta struct {
+	Type        string `json:"type"`
+	CanSave     bool   `json:"canSave"`
+	CanEdit     bool   `json:"canEdit"`
+	Slug        string `json:"slug"`
+	Url         string `json:"url"`
+	Version     int    `json:"version"`
+	Created     string `json:"created"`
+	Updated     string `json:"updated"`
+	FolderId    int    `json:"folderId"`
+	FolderUid   string `json:"folderUid"`
+	FolderTitle string `json:"folderTitle"`
+	FolderUrl   string `json:"folderUrl"`
+	Provisioned bool   `json:"provisioned"`
+}
+
+// DashboardSaveResult is the answer of grafana after saving a dashboard
+type DashboardSaveResult struct {
+	Id      int    `json:"id"`
+	Uid     string `json:"uid"`
+	Url     string `json:"url"`
+	Slug    string `json:"slug"`
+	Status  string `json:"status"`
+	Version int    `json:"version"`
+}
+
+// Uid returns the uid of the dashboard model or "" if it has none
+func (d *Dashboard) Uid() string {
+	return d.modelString("uid")
+}
+
+// Title returns the title of the dashboard model
+func (d *Dashboard) Title() string {
+	return d.modelString("title")
+}
+
+// Version returns the version of the dashboard model or 0 if it has none
+func (d *Dashboard) Version() int {
+	if v, ok := d.Model["version"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// Tags returns the tags of the dashboard model
+func (d *Dashboard) Tags() []string {
+	var tags []string
+	if vs, ok := d.Model["tags"].([]interface{}); ok {
+		for _, v := range vs {
+			if tag, ok := v.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	} else if vs, ok := d.Model["tags"].([]string); ok {
+		tags = append(tags, vs...)
+	}
+	return tags
+}
+
+// SetTags sets the tags of the dashboard model
+func (d *Dashboard) SetTags(tags []string) {
+	if d.Model == nil {
+		d.Model = make(map[string]interface{})
+	}
+	vs := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		vs[i] = tag
+	}
+	d.Model["tags"] = vs
+}
+
+// SetUid sets the uid of the dashboard model
+func (d *Dashboard) SetUid(uid string) {
+	if d.Model == nil {
+		d.Model = make(map[string]interface{})
+	}
+	d.Model["uid"] = uid
+}
+
+// LibraryPanelUids returns the uids of the library panels the dashboard model uses, also those in collapsed rows
+func (d *Dashboard) LibraryPanelUids() []string {
+	var uids []string
+	var walk func(panels interface{})
+	walk = func(panels interface{}) {
+		vs, _ := panels.([]interface{})
+		for _, v := range vs {
+			panel, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if libraryPanel, ok := panel["libraryPanel"].(map[string]interface{}); ok {
+				if uid, ok := libraryPanel["uid"].(string); ok && uid != "" {
+					uids = append(uids, uid)
+				}
+			}
+			walk(panel["panels"])
+		}
+	}
+	walk(d.Model["panels"])
+	return uids
+}
+
+func (d *Dashboard) modelString(key string) string {
+	if v, ok := d.Model[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// Datasource is a grafana datasource
+type Datasource struct {
+	Id                int                    `json:"id,omitempty"`
+	Uid               string                 `json:"uid,omitempty"`
+	OrgId             int                    `json:"orgId,omitempty"`
+	Name              string                 `json:"name"`
+	Type              string                 `json:"type"`
+	TypeLogoUrl       string                 `json:"typeLogoUrl,omitempty"`
+	Access            string                 `json:"access"`
+	Url               string                 `json:"url"`
+	User              string                 `json:"user,omitempty"`
+	Password          string                 `json:"password,omitempty"`
+	Database          string                 `json:"database,omitempty"`
+	BasicAuth         bool                   `json:"basicAuth"`
+	BasicAuthUser     string                 `json:"basicAuthUser,omitempty"`
+	BasicAuthPassword string                 `json:"basicAuthPassword,omitempty"`
+	WithCredentials   bool                   `json:"withCredentials"`
+	IsDefault         bool                   `json:"isDefault"`
+	JsonData          map[string]interface{} `json:"jsonData,omitempty"`
+	SecureJsonData    map[string]string      `json:"secureJsonData,omitempty"`
+	Version           int                    `json:"version,omitempty"`
+	ReadOnly          bool                   `json:"readOnly,omitempty"`
+}
+
+// NotificationChannel is a legacy grafana alert notification channel
+type NotificationChannel struct {
+	Id                    int                    `json:"id,omitempty"`
+	Uid                   string                 `json:"uid,omitempty"`
+	Name                  string                 `json:"name"`
+	Type                  string                 `json:"type"`
+	IsDefault             bool                   `json:"isDefault"`
+	SendReminder          bool                   `json:"sendReminder"`
+	DisableResolveMessage bool                   `json:"disableResolveMessage"`
+	Frequency             string                 `json:"frequency,omitempty"`
+	Settings              map[string]interface{} `json:"settings"`
+	Created               string                 `json:"created,omitempty"`
+	Updated               string                 `json:"updated,omitempty"`
+}
+
+// Folder is a grafana dashboard folder
+type Folder struct {
+	Id      int    `json:"id,omitempty"`
+	Uid     string `json:"uid,omitempty"`
+	Title   string `json:"title"`
+	Url     string `json:"url,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// User is a grafana user as accepted by the admin api
+type User struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`
+	OrgId    int    `json:"orgId,omitempty"`
+}
+
+// Org is a grafana organization
+type Org struct {
+	Id   int    `json:"id,omitempty"`
+	Name string `json:"name"`
+}